@@ -0,0 +1,256 @@
+package axel
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+)
+
+// BatchItem is a file to be downloaded in a batch
+type BatchItem struct {
+	URL      string `json:"url"`                // remote url
+	Save     string `json:"save,omitempty"`     // local save path, default the base name of the url
+	Checksum string `json:"checksum,omitempty"` // expected checksum in format of `<algo>:<hex>`
+}
+
+// BatchOptions is the optional settings of a batch download
+type BatchOptions struct {
+	// MaxFiles is the max nb of files being downloaded concurrently, default 2,
+	// it's limited by MaxConns as each file takes a connection at least.
+	MaxFiles int
+	// MaxConns is the max nb of connections of all the files, default NumCPU*2,
+	// each file is downloaded by MaxConns/MaxFiles connections.
+	MaxConns int
+	// ConnTimeout is the connection timeout, default 10s
+	ConnTimeout time.Duration
+
+	// Dir is the dir to save the files with relative save path
+	Dir string
+
+	// Options is the options of each file, the Checksum and OnProgress are
+	// replaced by the item's checksum and the following OnProgress.
+	Options *Options
+
+	// OnProgress is called with the progress snapshot of each file being downloaded
+	OnProgress func(*BatchItem, *Progress)
+	// OnResult is called once each file is done, the calls are serialized
+	OnResult func(*BatchResult)
+}
+
+// BatchResult is the result of a file in the batch
+type BatchResult struct {
+	URL      string        `json:"url"`             // remote url
+	Save     string        `json:"save"`            // local save path
+	Size     int64         `json:"size"`            // received bytes
+	Elapsed  time.Duration `json:"elapsed"`         // elapsed time of the download
+	AvgSpeed float64       `json:"avg_speed"`       // average speed, bytes/s
+	Error    string        `json:"error,omitempty"` // error message, empty means succeed
+}
+
+// ParseBatchFile parse the url list file, see ParseBatch
+func ParseBatchFile(path string) ([]*BatchItem, error) {
+	fd, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return ParseBatch(fd)
+}
+
+// ParseBatch parse the url list, each line is a file to be downloaded:
+//
+//	<url> [save] [checksum]
+//
+// the checksum is in format of `<algo>:<hex>`, the save path could be omitted
+// before the checksum. the blank lines and the lines start with # are ignored.
+func ParseBatch(r io.Reader) ([]*BatchItem, error) {
+	var (
+		items   = make([]*BatchItem, 0)
+		scanner = bufio.NewScanner(r)
+		lineno  int
+	)
+
+	for scanner.Scan() {
+		lineno++
+
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) > 3 {
+			return nil, fmt.Errorf("line %d: too many fields, should be <url> [save] [checksum]", lineno)
+		}
+
+		item := &BatchItem{URL: fields[0]}
+		for _, field := range fields[1:] {
+			if isChecksum(field) {
+				if _, err := parseChecksum(field); err != nil {
+					return nil, fmt.Errorf("line %d: %v", lineno, err)
+				}
+				item.Checksum = field
+				continue
+			}
+			if item.Save != "" || item.Checksum != "" {
+				return nil, fmt.Errorf("line %d: unexpected field %q, should be <url> [save] [checksum]", lineno, field)
+			}
+			item.Save = field
+		}
+
+		items = append(items, item)
+	}
+
+	return items, scanner.Err()
+}
+
+// isChecksum check if the field looks like a checksum: a known algorithm followed by colon
+func isChecksum(field string) bool {
+	idx := strings.Index(field, ":")
+	if idx <= 0 {
+		return false
+	}
+	_, ok := hashers[normalizeAlgo(field[:idx])]
+	return ok
+}
+
+// DownloadBatch download the files with the concurrency limits, and return
+// the results by the order of the items, a failed file doesn't stop the others.
+// the not started files are failed with the ctx error once the ctx is done.
+func DownloadBatch(ctx context.Context, items []*BatchItem, opts *BatchOptions) ([]*BatchResult, error) {
+	if opts == nil {
+		opts = &BatchOptions{}
+	}
+
+	// set up default parameters
+	maxFiles := opts.MaxFiles
+	if maxFiles <= 0 {
+		maxFiles = 2
+	}
+	maxConns := opts.MaxConns
+	if maxConns <= 0 {
+		maxConns = runtime.NumCPU() * 2
+	}
+	if maxFiles > maxConns {
+		maxFiles = maxConns
+	}
+	conn := maxConns / maxFiles
+	connTimeout := opts.ConnTimeout
+	if connTimeout <= 0 {
+		connTimeout = time.Second * 10
+	}
+	var template Options
+	if opts.Options != nil {
+		template = *opts.Options
+	}
+	if err := template.valid(); err != nil {
+		return nil, err
+	}
+
+	// resolve the save paths, each file must be saved to a different path
+	saves := make([]string, len(items))
+	seen := make(map[string]int)
+	for i, item := range items {
+		if item.URL == "" {
+			return nil, fmt.Errorf("item %d: empty url", i+1)
+		}
+		if item.Checksum != "" {
+			if _, err := parseChecksum(item.Checksum); err != nil {
+				return nil, fmt.Errorf("item %d: %v", i+1, err)
+			}
+		}
+
+		save := item.Save
+		if save == "" {
+			save = filepath.Base(item.URL)
+		}
+		if opts.Dir != "" && !filepath.IsAbs(save) {
+			save = filepath.Join(opts.Dir, save)
+		}
+		if j, ok := seen[save]; ok {
+			return nil, fmt.Errorf("item %d and %d are saved to the same path [%s]", j+1, i+1, save)
+		}
+		seen[save] = i
+		saves[i] = save
+	}
+
+	var (
+		results = make([]*BatchResult, len(items))
+		sem     = make(chan struct{}, maxFiles) // limit the concurrent files
+		wg      sync.WaitGroup
+		mux     sync.Mutex // serialize the OnResult calls
+	)
+
+	done := func(result *BatchResult) {
+		if opts.OnResult != nil {
+			mux.Lock()
+			opts.OnResult(result)
+			mux.Unlock()
+		}
+	}
+
+	for i, item := range items {
+		select {
+		case sem <- struct{}{}:
+		case <-ctx.Done():
+		}
+		if err := ctx.Err(); err != nil {
+			results[i] = &BatchResult{URL: item.URL, Save: saves[i], Error: err.Error()}
+			done(results[i])
+			continue
+		}
+
+		o := template
+		o.Checksum = item.Checksum
+		o.OnProgress = nil
+		if opts.OnProgress != nil {
+			item := item
+			o.OnProgress = func(p *Progress) { opts.OnProgress(item, p) }
+		}
+
+		wg.Add(1)
+		go func(i int, item *BatchItem, o *Options) {
+			defer wg.Done()
+			defer func() { <-sem }()
+
+			results[i] = downloadItem(ctx, item, saves[i], conn, connTimeout, o)
+			done(results[i])
+		}(i, item, &o)
+	}
+	wg.Wait()
+
+	return results, nil
+}
+
+// downloadItem download a file of the batch
+func downloadItem(ctx context.Context, item *BatchItem, save string, conn int, connTimeout time.Duration, opts *Options) *BatchResult {
+	result := &BatchResult{URL: item.URL, Save: save}
+
+	if err := os.MkdirAll(filepath.Dir(save), os.FileMode(0755)); err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	axel, err := NewWithOptions(item.URL, save, conn, connTimeout, opts)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+
+	err = axel.DownloadContext(ctx)
+	if err != nil {
+		result.Error = err.Error()
+	}
+
+	p := axel.Progress()
+	result.Size, result.Elapsed, result.AvgSpeed = p.Received, p.Elapsed, p.AvgSpeed
+	return result
+}
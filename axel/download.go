@@ -0,0 +1,618 @@
+package axel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	rate "../rate-limit"
+)
+
+var (
+	// the max backoff between chunk retries
+	maxRetryBackoff = time.Second * 30
+
+	// the min size of each piece when stealing by splitting an in-flight chunk
+	minSplitSize = int64(1024 * 1024)
+
+	// errChunkDone means the chunk reached it's end during copying
+	errChunkDone = errors.New("chunk done")
+)
+
+// downloader is the protocol independent download accelerator, it splits
+// the remote file into chunks and fetches them concurrently by the backend.
+type downloader struct {
+	// options
+	backend backend // protocol backend
+	save    string  // local save path
+	conn    int     // nb of connections, note: maybe reset as 1 if not support partial download
+	resume  bool    // resume the previous broken download by the chunks state file
+
+	retries      int           // max retries of each chunk
+	retryBackoff time.Duration // the initial backoff between retries
+
+	onProgress       func(*Progress) // progress callback
+	progressInterval time.Duration   // progress callback interval
+
+	checksums    []*checksum // user supplied checksums
+	verifyDigest bool        // verify by the remote checksums
+
+	speedLimiter rate.Limiter // global speed limiter, nil means unlimited
+	maxConnSpeed int          // speed limit of each connection, bytes/s, 0 means unlimited
+
+	// download runtime fields
+	startAt     time.Time  // start time
+	totalSize   int64      // total size
+	supportPart bool       // support partial download
+	partFile    string     // the file being downloaded, renamed as the save path on success
+	partfd      *os.File   // opened part file, each chunk is written at its offset
+	stateFile   string     // chunks state file, only persisted under resume mode
+	state       *state     // chunks state
+	chunkErrs   []string   // held chunk errors  list
+	ckerrmux    sync.Mutex // protect above list
+	wg          sync.WaitGroup
+
+	// progress runtime fields
+	pmux     sync.RWMutex // protect startAt, totalSize, state & resumed against Progress() calls
+	received int64        // received bytes by direct save, atomic
+	resumed  int64        // bytes already received before this download
+	meter    *speedMeter  // instantaneous speed meter
+}
+
+// backend is the protocol backend of the downloader
+type backend interface {
+	// probe return the remote file's meta, and optionally a stream of
+	// the whole file which could be directly saved, the downloader will
+	// close the stream if it's not used.
+	probe(ctx context.Context) (*remoteMeta, io.ReadCloser, error)
+
+	// fetch return a stream of the remote file's byte range [start, end],
+	// end -1 means till the end of the file.
+	// note: the stream may go beyond the end, the downloader stops reading
+	// once reached the end.
+	// the stream must be aborted once the ctx is done.
+	fetch(ctx context.Context, start, end int64) (io.ReadCloser, error)
+}
+
+// remoteMeta is the remote file's meta
+type remoteMeta struct {
+	size         int64       // total size, -1 means unknown
+	supportPart  bool        // support partial download
+	etag         string      // validator, empty if not provided
+	lastModified string      // validator, empty if not provided
+	checksums    []*checksum // checksums provided by the remote, eg: Digest header
+}
+
+func newDownloader(b backend, save string, conn int, opts *Options) *downloader {
+	// set up default parameters
+	if conn <= 0 {
+		conn = runtime.NumCPU() * 2
+	}
+	backoff := opts.RetryBackoff
+	if backoff <= 0 {
+		backoff = time.Second
+	}
+	interval := opts.ProgressInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	checksums := make([]*checksum, 0)
+	if opts.Checksum != "" {
+		sum, _ := parseChecksum(opts.Checksum) // note: verified by opts.valid()
+		checksums = append(checksums, sum)
+	}
+
+	var speedLimiter rate.Limiter
+	if opts.MaxSpeed > 0 {
+		speedLimiter = newSpeedLimiter(opts.MaxSpeed)
+	}
+
+	return &downloader{
+		backend: b,
+		save:    save,
+		conn:    conn,
+		resume:  opts.Resume,
+
+		retries:      opts.Retries,
+		retryBackoff: backoff,
+
+		onProgress:       opts.OnProgress,
+		progressInterval: interval,
+
+		checksums:    checksums,
+		verifyDigest: opts.VerifyDigest,
+
+		speedLimiter: speedLimiter,
+		maxConnSpeed: opts.MaxConnSpeed,
+
+		startAt: time.Now(),
+		meter:   newSpeedMeter(time.Second * 5),
+	}
+}
+
+// Download implement the Axel interface
+func (a *downloader) Download() error {
+	return a.DownloadContext(context.Background())
+}
+
+// DownloadContext implement the Axel interface
+func (a *downloader) DownloadContext(ctx context.Context) error {
+	// if save path exists, return conflicts
+	if _, err := os.Stat(a.save); err == nil {
+		return fmt.Errorf("conflicts, save path [%s] already exists", a.save)
+	}
+
+	a.pmux.Lock()
+	a.startAt = time.Now()
+	a.pmux.Unlock()
+
+	// get the remote meta & size
+	// prepare for the chunk size
+	meta, stream, err := a.backend.probe(ctx)
+	if err != nil {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		return err
+	}
+	if stream != nil {
+		defer stream.Close()
+	}
+
+	// detect total size & partial support
+	// note: reset conn=1 if total size unknown
+	// note: reset conn=1 if not supported partial download
+	a.pmux.Lock()
+	a.totalSize = meta.size
+	a.pmux.Unlock()
+	a.supportPart = meta.supportPart
+	if a.totalSize <= 1 || !a.supportPart {
+		a.conn = 1
+	}
+	if a.totalSize > 0 && int64(a.conn) > a.totalSize {
+		a.conn = int(a.totalSize)
+	}
+
+	// report the progress periodically
+	// note: the final progress is reported after the loop exits, so
+	// it's always the last call of the callback
+	if a.onProgress != nil {
+		stopCh, doneCh := make(chan struct{}), make(chan struct{})
+		defer func() {
+			close(stopCh)
+			<-doneCh
+			a.onProgress(a.Progress())
+		}()
+		go func() {
+			a.progressLoop(stopCh)
+			close(doneCh)
+		}()
+	}
+
+	// every byte is written into the part file firstly,
+	// and renamed as the save path once all done & verified
+	a.partFile = a.save + ".part"
+	a.stateFile = a.save + ".st"
+
+	// directly download and save
+	// note: resuming relies on partial download, so a single connection
+	// download still goes through the chunks under resume mode
+	if !a.supportPart || a.totalSize <= 1 || (a.conn == 1 && !a.resume) {
+		if stream == nil {
+			if stream, err = a.backend.fetch(ctx, 0, -1); err != nil {
+				return err
+			}
+			defer stream.Close()
+		}
+		if err := a.directSave(ctx, stream); err != nil {
+			os.Remove(a.partFile)
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		return a.finish(meta)
+	}
+
+	// the probe stream is not used, release its connection before the chunks
+	if stream != nil {
+		stream.Close()
+	}
+
+	// partial downloa and save by concurrency
+	// load the previous chunks state or split new chunks
+	err = a.prepareState(meta)
+	if err != nil {
+		return err
+	}
+	defer a.partfd.Close()
+	if !a.resume {
+		defer os.Remove(a.partFile) // note: no-op if renamed
+	}
+
+	// concurrency get each chunks
+	err = a.getAllChunks(ctx)
+	if err != nil {
+		return err
+	}
+
+	// each chunk must be exactly the requested range
+	if c := a.state.incomplete(); c != nil {
+		return newChunkErr(c.Idx, c.Start, c.End, fmt.Errorf("incomplete chunk, %d bytes received", c.Written))
+	}
+	if err := a.partfd.Close(); err != nil {
+		return err
+	}
+
+	// verify and rename as the final save path
+	err = a.finish(meta)
+
+	// all done or the part file is corrupted, the state file is useless now
+	if a.resume {
+		os.Remove(a.stateFile)
+	}
+	return err
+}
+
+// finish verify the part file against the user supplied checksums, and the
+// remote checksums if required, then rename the part file as the save path.
+// the corrupted part file is removed.
+func (a *downloader) finish(meta *remoteMeta) error {
+	sums := append([]*checksum{}, a.checksums...)
+	if a.verifyDigest {
+		sums = append(sums, meta.checksums...)
+	}
+
+	if err := verifyFile(a.partFile, sums); err != nil {
+		os.Remove(a.partFile)
+		return err
+	}
+
+	return os.Rename(a.partFile, a.save)
+}
+
+// prepareState load the chunks state from the state file under resume mode,
+// the remote validators must be unchanged, otherwise refuse to resume.
+// if no previous state found, split the total size into chunks.
+func (a *downloader) prepareState(meta *remoteMeta) error {
+	st, resumed, err := a.loadState(meta)
+	if err != nil {
+		return err
+	}
+
+	if err := a.openPartFile(st, resumed); err != nil {
+		return err
+	}
+
+	var n int64
+	for _, c := range st.Chunks {
+		n += c.Written
+	}
+
+	a.pmux.Lock()
+	a.state = st
+	a.resumed = n
+	a.pmux.Unlock()
+	return nil
+}
+
+// loadState return the chunks state, and whether it's resumed from the state file
+func (a *downloader) loadState(meta *remoteMeta) (*state, bool, error) {
+	if a.resume {
+		st, err := loadState(a.stateFile)
+		if err == nil {
+			if err := st.validate(meta.size, meta.etag, meta.lastModified); err != nil {
+				return nil, false, err
+			}
+			return st, true, nil
+		}
+		if !os.IsNotExist(err) {
+			return nil, false, err
+		}
+	}
+
+	return newState(meta.size, meta.etag, meta.lastModified, a.conn), false, nil
+}
+
+// openPartFile open the part file for the chunks state, the part file
+// is preallocated as the total size unless resuming from it.
+func (a *downloader) openPartFile(st *state, resumed bool) error {
+	fd, err := os.OpenFile(a.partFile, os.O_CREATE|os.O_RDWR, os.FileMode(0644))
+	if err != nil {
+		return err
+	}
+
+	// the part file is lost or broken, start over
+	if resumed {
+		if info, err := fd.Stat(); err != nil || info.Size() != st.Size {
+			resumed = false
+			for _, c := range st.Chunks {
+				c.Written = 0
+			}
+		}
+	}
+
+	if !resumed {
+		if err := fd.Truncate(0); err != nil {
+			fd.Close()
+			return err
+		}
+		if err := preallocate(fd, st.Size); err != nil {
+			fd.Close()
+			return err
+		}
+	}
+
+	a.partfd = fd
+	return nil
+}
+
+func (a *downloader) directSave(ctx context.Context, stream io.ReadCloser) error {
+	savefd, err := os.Create(a.partFile)
+	if err != nil {
+		return err
+	}
+	defer savefd.Close()
+
+	var connLimiter rate.Limiter
+	if a.maxConnSpeed > 0 {
+		connLimiter = newSpeedLimiter(a.maxConnSpeed)
+	}
+
+	n, err := io.Copy(savefd, newThrottleReader(ctx, &countReader{stream, &a.received}, connLimiter, a.speedLimiter))
+	if err != nil {
+		return err
+	}
+
+	if a.totalSize > 0 && n != a.totalSize {
+		return fmt.Errorf("short read, %d bytes received, %d bytes expected", n, a.totalSize)
+	}
+	return savefd.Close()
+}
+
+func (a *downloader) getAllChunks(ctx context.Context) error {
+	a.wg = sync.WaitGroup{}
+	a.chunkErrs = make([]string, 0, 0)
+
+	// persist the chunks state periodically under resume mode
+	// note: the final state is saved after the loop exits, so
+	// it's never overwritten by a stale one of the loop
+	if a.resume {
+		stopCh, doneCh := make(chan struct{}), make(chan struct{})
+		defer func() {
+			close(stopCh)
+			<-doneCh
+			a.saveState()
+		}()
+		go func() {
+			a.saveStateLoop(stopCh)
+			close(doneCh)
+		}()
+	}
+
+	// each connection keeps fetching pending chunks, or steals the tail
+	// of the largest in-flight chunk once there are no pending ones
+	a.wg.Add(a.conn)
+	for i := 1; i <= a.conn; i++ {
+		go a.worker(ctx)
+	}
+	a.wg.Wait()
+
+	// the chunk errors are caused by the cancellation
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	if len(a.chunkErrs) != 0 {
+		return errors.New(strings.Join(a.chunkErrs, ","))
+	}
+	return nil
+}
+
+// Progress implement the Axel interface
+func (a *downloader) Progress() *Progress {
+	a.pmux.RLock()
+	var (
+		total   = a.totalSize
+		st      = a.state
+		resumed = a.resumed
+		startAt = a.startAt
+	)
+	a.pmux.RUnlock()
+
+	p := &Progress{
+		Total:    total,
+		Received: atomic.LoadInt64(&a.received),
+		Elapsed:  time.Since(startAt),
+		ETA:      -1,
+		Chunks:   make([]*ChunkProgress, 0),
+	}
+
+	if st != nil {
+		p.Received = 0
+		st.Lock()
+		for _, c := range st.Chunks {
+			p.Received += c.Written
+			p.Chunks = append(p.Chunks, c.progress())
+		}
+		st.Unlock()
+	}
+
+	if secs := p.Elapsed.Seconds(); secs > 0 {
+		p.AvgSpeed = float64(p.Received-resumed) / secs
+	}
+	p.Speed = a.meter.speed(p.Received)
+
+	if speed := p.Speed; total > 0 && speed > 0 {
+		p.ETA = time.Duration(float64(total-p.Received) / speed * float64(time.Second))
+	}
+
+	return p
+}
+
+func (a *downloader) progressLoop(stopCh chan struct{}) {
+	ticker := time.NewTicker(a.progressInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.onProgress(a.Progress())
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+func (a *downloader) saveStateLoop(stopCh chan struct{}) {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			a.saveState()
+		case <-stopCh:
+			return
+		}
+	}
+}
+
+// saveState persist the chunks state, the part file is synced before
+// writing the state file, so the recorded bytes are always on the disk.
+func (a *downloader) saveState() error {
+	return a.state.save(a.stateFile, a.partfd.Sync)
+}
+
+func (a *downloader) worker(ctx context.Context) {
+	defer a.wg.Done()
+
+	// each connection has its own speed limiter
+	var connLimiter rate.Limiter
+	if a.maxConnSpeed > 0 {
+		connLimiter = newSpeedLimiter(a.maxConnSpeed)
+	}
+
+	for ctx.Err() == nil {
+		c := a.state.next(minSplitSize)
+		if c == nil {
+			return
+		}
+
+		err := a.getChunk(ctx, c, connLimiter)
+		a.state.release(c, err != nil)
+		if err != nil {
+			a.addChunkErr(err)
+			return
+		}
+	}
+}
+
+// getChunk fetch the missing bytes of the chunk with retries,
+// the backoff doubles after each failed attempt
+func (a *downloader) getChunk(ctx context.Context, c *chunk, connLimiter rate.Limiter) error {
+	var (
+		backoff = a.retryBackoff
+		err     error
+	)
+
+	for i := 0; i <= a.retries; i++ {
+		if i > 0 {
+			select {
+			case <-ctx.Done():
+				return err
+			case <-time.After(backoff):
+			}
+			if backoff *= 2; backoff > maxRetryBackoff {
+				backoff = maxRetryBackoff
+			}
+		}
+
+		if err = a.fetchChunk(ctx, c, connLimiter); err == nil || ctx.Err() != nil {
+			return err
+		}
+	}
+
+	return err
+}
+
+func (a *downloader) fetchChunk(ctx context.Context, c *chunk, connLimiter rate.Limiter) error {
+	// fetch the missing bytes
+	var (
+		written, end = a.state.progress(c)
+		begin        = c.Start + written
+	)
+
+	stream, err := a.backend.fetch(ctx, begin, end)
+	if err != nil {
+		return newChunkErr(c.Idx, begin, end, err)
+	}
+	defer stream.Close()
+
+	// note: the chunk's tail maybe stolen by other connections during copying,
+	// the chunkWriter stops the copying once reached the chunk's new end
+	_, err = io.Copy(&chunkWriter{a.partfd, a.state, c}, newThrottleReader(ctx, stream, connLimiter, a.speedLimiter))
+	if err != nil && err != errChunkDone {
+		return newChunkErr(c.Idx, begin, end, err)
+	}
+
+	if written, end = a.state.progress(c); c.Start+written <= end {
+		return newChunkErr(c.Idx, begin, end, fmt.Errorf("short read, %d bytes missing", end-c.Start-written+1))
+	}
+	return nil
+}
+
+func (a *downloader) addChunkErr(err error) {
+	a.ckerrmux.Lock()
+	a.chunkErrs = append(a.chunkErrs, err.Error())
+	a.ckerrmux.Unlock()
+}
+
+// chunkWriter write the chunk at its offset of the part file, and record the
+// written bytes to the chunks state on each write, never writes beyond the
+// chunk's end
+type chunkWriter struct {
+	w io.WriterAt
+	s *state
+	c *chunk
+}
+
+func (cw *chunkWriter) Write(p []byte) (int, error) {
+	n := cw.s.reserve(cw.c, int64(len(p)))
+	if n <= 0 {
+		return 0, errChunkDone
+	}
+
+	// note: only the chunk's writer moves the written bytes forward
+	m, err := cw.w.WriteAt(p[:n], cw.c.Start+cw.c.Written)
+	cw.s.commit(cw.c, int64(m))
+	if err != nil {
+		return m, err
+	}
+	if m < len(p) {
+		return m, errChunkDone
+	}
+	return m, nil
+}
+
+type chunkErr struct {
+	idx   int
+	start int64
+	end   int64
+	err   error
+}
+
+func (e *chunkErr) Error() string {
+	return fmt.Sprintf("%d: fetch data chunk %d-%d error: %s", e.idx, e.start, e.end, e.err.Error())
+}
+
+func newChunkErr(idx int, start, end int64, err error) *chunkErr {
+	return &chunkErr{idx, start, end, err}
+}
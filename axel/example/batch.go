@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"text/tabwriter"
+	"time"
+
+	"../../axel"
+)
+
+// runBatch download the files of the url list, print a line once each file
+// is done and a summary table at the end, and optionally write the json result.
+func runBatch(ctx context.Context, opts *axel.Options) error {
+	items, err := axel.ParseBatchFile(*batch)
+	if err != nil {
+		return err
+	}
+
+	results, err := axel.DownloadBatch(ctx, items, &axel.BatchOptions{
+		MaxFiles:    *files,
+		MaxConns:    *conn,
+		ConnTimeout: time.Second * 10,
+		Dir:         *dir,
+		Options:     opts,
+		OnResult: func(r *axel.BatchResult) {
+			if r.Error != "" {
+				fmt.Printf("-ERR %s: %s\n", r.URL, r.Error)
+			} else {
+				fmt.Printf("+OK  %s -> %s\n", r.URL, r.Save)
+			}
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	var failed int
+	tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(tw, "\nSTATUS\tSAVE\tSIZE\tELAPSED\tSPEED\tERROR")
+	for _, r := range results {
+		status := "OK"
+		if r.Error != "" {
+			status = "FAILED"
+			failed++
+		}
+		fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s/s\t%s\n", status, r.Save, humanSize(r.Size),
+			r.Elapsed.Round(time.Millisecond), humanSize(int64(r.AvgSpeed)), r.Error)
+	}
+	tw.Flush()
+
+	if *jsonResult != "" {
+		bs, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(*jsonResult, bs, os.FileMode(0644)); err != nil {
+			return err
+		}
+	}
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d files failed", failed, len(results))
+	}
+	return nil
+}
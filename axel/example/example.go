@@ -1,20 +1,74 @@
 package main
 
 import (
+	"context"
+	"flag"
 	"log"
 	"os"
+	"os/signal"
 	"time"
 
 	"../../axel"
 )
 
+var (
+	remoteURL = flag.String("url", "http://192.168.156.101:81/tmp/10M", "remote url")
+	save      = flag.String("save", "./10M", "local save path")
+	conn      = flag.Int("n", 10, "nb of connections, the total of all files under batch mode")
+	resume    = flag.Bool("resume", false, "resume the previous broken download")
+	verbose   = flag.Bool("v", false, "show each connection's progress")
+	maxSpeed  = flag.Int("max-speed", 0, "max total speed, bytes/s, 0 means unlimited")
+	connSpeed = flag.Int("max-conn-speed", 0, "max speed of each connection, bytes/s, 0 means unlimited")
+	proxy     = flag.String("proxy", "", "http or socks5 proxy url, default from the environment")
+	caFile    = flag.String("cacert", "", "CA bundle to verify the server certificates")
+	insecure  = flag.Bool("insecure", false, "skip the server certificates verification")
+
+	// batch mode
+	batch      = flag.String("batch", "", "url list file, each line: <url> [save] [checksum]")
+	files      = flag.Int("files", 2, "nb of files downloaded concurrently under batch mode")
+	dir        = flag.String("dir", ".", "save dir under batch mode")
+	jsonResult = flag.String("json", "", "write the batch result as json into the file")
+)
+
 func main() {
-	axel, err := axel.New("http://192.168.156.101:81/tmp/10M", "./10M", 10, time.Second*10)
+	flag.Parse()
+
+	// abort on ctrl-c, the broken download could be resumed by -resume
+	ctx, cancel := context.WithCancel(context.Background())
+	sigCh := make(chan os.Signal, 1)
+	signal.Notify(sigCh, os.Interrupt)
+	go func() {
+		<-sigCh
+		cancel()
+	}()
+
+	opts := &axel.Options{
+		Resume:       *resume,
+		MaxSpeed:     *maxSpeed,
+		MaxConnSpeed: *connSpeed,
+		HTTP: &axel.HTTPOptions{
+			Proxy:              *proxy,
+			CAFile:             *caFile,
+			InsecureSkipVerify: *insecure,
+		},
+	}
+
+	if *batch != "" {
+		if err := runBatch(ctx, opts); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	bar := newProgressBar(os.Stdout, 40, *verbose)
+	opts.OnProgress = bar.Render
+
+	axel, err := axel.NewWithOptions(*remoteURL, *save, *conn, time.Second*10, opts)
 	if err != nil {
 		log.Fatalln(err)
 	}
 
-	err = axel.Download()
+	err = axel.DownloadContext(ctx)
 	if err != nil {
 		log.Fatalln(err)
 	}
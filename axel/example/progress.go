@@ -0,0 +1,99 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"../../axel"
+)
+
+// progressBar renders the axel progress as a CLI progress bar like:
+//
+//	[=================>                      ]  45.3%   4.5MiB/10.0MiB   1.2MiB/s  ETA 5s
+//
+// under verbose mode, each connection's progress is rendered below the bar
+type progressBar struct {
+	w       io.Writer
+	width   int  // bar width
+	verbose bool // render each connection's progress
+	lines   int  // nb of lines rendered last time
+}
+
+func newProgressBar(w io.Writer, width int, verbose bool) *progressBar {
+	return &progressBar{
+		w:       w,
+		width:   width,
+		verbose: verbose,
+	}
+}
+
+// Render redraw the progress bar by the progress snapshot
+func (b *progressBar) Render(p *axel.Progress) {
+	lines := []string{b.bar(p)}
+	if b.verbose {
+		for _, c := range p.Chunks {
+			if c.Active {
+				lines = append(lines, connLine(c))
+			}
+		}
+	}
+
+	// move the cursor up to overwrite the lines rendered last time
+	if b.lines > 1 {
+		fmt.Fprintf(b.w, "\033[%dA", b.lines-1)
+	}
+	fmt.Fprintf(b.w, "\r\033[J%s", strings.Join(lines, "\n"))
+	b.lines = len(lines)
+
+	if p.Total > 0 && p.Received >= p.Total {
+		fmt.Fprintln(b.w)
+		b.lines = 0
+	}
+}
+
+func (b *progressBar) bar(p *axel.Progress) string {
+	percent := p.Percent()
+	if percent < 0 { // unknown total size
+		return fmt.Sprintf("[%s]  %s  %s/s", strings.Repeat("?", b.width), humanSize(p.Received), humanSize(int64(p.Speed)))
+	}
+
+	filled := int(percent / 100 * float64(b.width))
+	if filled > b.width {
+		filled = b.width
+	}
+
+	bar := strings.Repeat("=", filled)
+	if filled < b.width {
+		bar += ">" + strings.Repeat(" ", b.width-filled-1)
+	}
+
+	eta := "--"
+	if p.ETA >= 0 {
+		eta = p.ETA.Truncate(time.Second).String()
+	}
+
+	return fmt.Sprintf("[%s] %5.1f%%  %9s/%-9s %9s/s  ETA %s",
+		bar, percent, humanSize(p.Received), humanSize(p.Total), humanSize(int64(p.Speed)), eta)
+}
+
+func connLine(c *axel.ChunkProgress) string {
+	size := c.End - c.Start + 1
+	return fmt.Sprintf("  #%-3d %12d-%-12d %5.1f%%  %9s/s",
+		c.Idx, c.Start, c.End, float64(c.Received)*100/float64(size), humanSize(int64(c.Speed)))
+}
+
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%ciB", float64(n)/float64(div), "KMGTPE"[exp])
+}
@@ -0,0 +1,19 @@
+//go:build linux
+// +build linux
+
+package axel
+
+import (
+	"os"
+	"syscall"
+)
+
+// preallocate allocate the disk space of the file by fallocate,
+// fallback to truncate if the filesystem doesn't support it
+func preallocate(fd *os.File, size int64) error {
+	err := syscall.Fallocate(int(fd.Fd()), 0, 0, size)
+	if err == syscall.EOPNOTSUPP || err == syscall.ENOSYS {
+		return fd.Truncate(size)
+	}
+	return err
+}
@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package axel
+
+import (
+	"os"
+)
+
+// preallocate extend the file as the size, the disk space is not
+// actually allocated on the platforms without fallocate
+func preallocate(fd *os.File, size int64) error {
+	return fd.Truncate(size)
+}
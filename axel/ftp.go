@@ -0,0 +1,330 @@
+package axel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/textproto"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	errFTPNoFile       = errors.New("ftp url without file path")
+	errFTPInvalidChars = errors.New("ftp url contains CR, LF or NUL characters")
+)
+
+// ftpBackend is the ftp backend of the downloader
+//
+// note: ftp allows only one transfer on each control connection, so each
+// fetching opens a new control connection with a passive mode data connection.
+type ftpBackend struct {
+	addr        string        // server address host:port
+	user        string        // login user, default anonymous
+	pass        string        // login password
+	dirs        []string      // directories to CWD into one by one, relative to the login directory
+	file        string        // remote file name, relative to the last of dirs
+	connTimeout time.Duration // connection timeout
+}
+
+func newFTPBackend(remoteURL string, connTimeout time.Duration) (*ftpBackend, error) {
+	u, err := url.Parse(remoteURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Path == "" || strings.HasSuffix(u.Path, "/") {
+		return nil, errFTPNoFile
+	}
+
+	b := &ftpBackend{
+		addr:        u.Host,
+		user:        "anonymous",
+		pass:        "anonymous@",
+		connTimeout: connTimeout,
+	}
+	if u.Port() == "" {
+		b.addr = net.JoinHostPort(u.Hostname(), "21")
+	}
+	if u.User != nil {
+		b.user = u.User.Username()
+		b.pass, _ = u.User.Password()
+	}
+
+	// note: the url path is relative to the login directory (RFC 1738), each of
+	// the decoded segments is CWD into except the last one, which is the file.
+	// the absolute path is given by an encoded slash, eg: ftp://host/%2Fpub/file
+	for _, seg := range strings.Split(strings.TrimPrefix(u.EscapedPath(), "/"), "/") {
+		seg, err := url.PathUnescape(seg)
+		if err != nil {
+			return nil, err
+		}
+		if seg != "" {
+			b.dirs = append(b.dirs, seg)
+		}
+	}
+	b.dirs, b.file = b.dirs[:len(b.dirs)-1], b.dirs[len(b.dirs)-1]
+
+	// note: the unescaped path & credentials are sent within the ftp commands,
+	// the CR LF could inject extra commands, eg: /file%0D%0ADELE%20other
+	for _, field := range append([]string{b.file, b.user, b.pass}, b.dirs...) {
+		if strings.ContainsAny(field, "\r\n\x00") {
+			return nil, errFTPInvalidChars
+		}
+	}
+
+	return b, nil
+}
+
+// probe implement the backend interface
+func (b *ftpBackend) probe(ctx context.Context) (*remoteMeta, io.ReadCloser, error) {
+	c, err := b.dial(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer c.quit()
+	defer closeOnDone(ctx, c.Close)()
+
+	meta := &remoteMeta{size: -1}
+
+	// the size is required for chunks download
+	if _, msg, err := c.cmd(213, "SIZE %s", b.file); err == nil {
+		if size, err := strconv.ParseInt(strings.TrimSpace(msg), 10, 64); err == nil {
+			meta.size = size
+		}
+	}
+
+	// the modification time is the only validator we have
+	if _, msg, err := c.cmd(213, "MDTM %s", b.file); err == nil {
+		meta.lastModified = strings.TrimSpace(msg)
+	}
+
+	// REST 0 is harmless to detect if the server support restart
+	if _, _, err := c.cmd(350, "REST 0"); err == nil {
+		meta.supportPart = true
+	}
+
+	return meta, nil, nil
+}
+
+// fetch implement the backend interface
+func (b *ftpBackend) fetch(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+	c, err := b.dial(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	stop := closeOnDone(ctx, c.Close)
+	data, err := c.retr(ctx, b.file, start)
+	stop()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+
+	// note: RETR streams till the end of the file, the downloader stops
+	// reading once reached the chunk's end
+	s := &ftpStream{Conn: data, ctrl: c}
+	s.stop = closeOnDone(ctx, s.abort)
+	return s, nil
+}
+
+// dial open a control connection and login
+func (b *ftpBackend) dial(ctx context.Context) (*ftpConn, error) {
+	dialer := &net.Dialer{Timeout: b.connTimeout}
+	conn, err := dialer.DialContext(ctx, "tcp", b.addr)
+	if err != nil {
+		return nil, err
+	}
+
+	host, _, _ := net.SplitHostPort(conn.RemoteAddr().String())
+	c := &ftpConn{
+		Conn:        textproto.NewConn(conn),
+		host:        host,
+		connTimeout: b.connTimeout,
+	}
+
+	stop := closeOnDone(ctx, c.Close)
+	defer stop()
+
+	if err := c.login(b.user, b.pass); err != nil {
+		c.Close()
+		return nil, err
+	}
+	for _, dir := range b.dirs {
+		if _, _, err := c.cmd(250, "CWD %s", dir); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// ftpConn is a minimal ftp client control connection
+type ftpConn struct {
+	*textproto.Conn
+	host        string        // server host, used for the passive data connection
+	connTimeout time.Duration // data connection timeout
+}
+
+// cmd send a command and read the response, expectCode
+// is checked by prefix, see textproto.Reader.ReadResponse
+func (c *ftpConn) cmd(expectCode int, format string, args ...interface{}) (int, string, error) {
+	id, err := c.Cmd(format, args...)
+	if err != nil {
+		return 0, "", err
+	}
+
+	c.StartResponse(id)
+	defer c.EndResponse(id)
+	return c.ReadResponse(expectCode)
+}
+
+func (c *ftpConn) login(user, pass string) error {
+	// welcome message
+	if _, _, err := c.ReadResponse(220); err != nil {
+		return err
+	}
+
+	code, msg, err := c.cmd(0, "USER %s", user)
+	if err != nil {
+		return err
+	}
+	switch code {
+	case 230: // no password required
+	case 331:
+		if _, _, err := c.cmd(230, "PASS %s", pass); err != nil {
+			return err
+		}
+	default:
+		return &textproto.Error{Code: code, Msg: msg}
+	}
+
+	// binary mode
+	_, _, err = c.cmd(200, "TYPE I")
+	return err
+}
+
+// pasv enter the passive mode and open the data connection,
+// try EPSV firstly and fallback to PASV
+func (c *ftpConn) pasv(ctx context.Context) (net.Conn, error) {
+	port, err := c.epsv()
+	if err != nil {
+		if port, err = c.pasv4(); err != nil {
+			return nil, err
+		}
+	}
+
+	// note: always connect to the control connection's host, as the address
+	// advertised by PASV is always wrong behind NAT
+	dialer := &net.Dialer{Timeout: c.connTimeout}
+	return dialer.DialContext(ctx, "tcp", net.JoinHostPort(c.host, strconv.Itoa(port)))
+}
+
+// epsv parse port from: 229 Entering Extended Passive Mode (|||6446|)
+func (c *ftpConn) epsv() (int, error) {
+	_, msg, err := c.cmd(229, "EPSV")
+	if err != nil {
+		return 0, err
+	}
+
+	start, end := strings.Index(msg, "(|||"), strings.LastIndex(msg, "|)")
+	if start < 0 || end < start+4 {
+		return 0, fmt.Errorf("invalid EPSV response: %s", msg)
+	}
+	return strconv.Atoi(msg[start+4 : end])
+}
+
+// pasv4 parse port from: 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+func (c *ftpConn) pasv4() (int, error) {
+	_, msg, err := c.cmd(227, "PASV")
+	if err != nil {
+		return 0, err
+	}
+
+	start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+	if start < 0 || end < start {
+		return 0, fmt.Errorf("invalid PASV response: %s", msg)
+	}
+	fields := strings.Split(msg[start+1:end], ",")
+	if len(fields) != 6 {
+		return 0, fmt.Errorf("invalid PASV response: %s", msg)
+	}
+
+	p1, err1 := strconv.Atoi(fields[4])
+	p2, err2 := strconv.Atoi(fields[5])
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("invalid PASV response: %s", msg)
+	}
+	return p1<<8 | p2, nil
+}
+
+// retr open the data connection and start transferring the file from offset
+func (c *ftpConn) retr(ctx context.Context, path string, offset int64) (net.Conn, error) {
+	data, err := c.pasv(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	if offset > 0 {
+		if _, _, err := c.cmd(350, "REST %d", offset); err != nil {
+			data.Close()
+			return nil, err
+		}
+	}
+
+	// 125 data connection already open; 150 about to open data connection
+	if _, _, err := c.cmd(1, "RETR %s", path); err != nil {
+		data.Close()
+		return nil, err
+	}
+
+	return data, nil
+}
+
+func (c *ftpConn) quit() error {
+	c.cmd(221, "QUIT")
+	return c.Close()
+}
+
+// ftpStream is the data connection of a RETR, closing it
+// closes the control connection as well.
+type ftpStream struct {
+	net.Conn
+	ctrl *ftpConn
+	stop func() // stop watching the ctx
+}
+
+func (s *ftpStream) Close() error {
+	s.stop()
+	return s.abort()
+}
+
+// abort close both of the data & control connection,
+// the transfer is aborted if not finished yet
+func (s *ftpStream) abort() error {
+	err := s.Conn.Close()
+	s.ctrl.Close()
+	return err
+}
+
+// closeOnDone call closeFn once the ctx is done, until the returned stop is called,
+// so that the blocking network ops are aborted by the ctx.
+func closeOnDone(ctx context.Context, closeFn func() error) (stop func()) {
+	var (
+		stopCh = make(chan struct{})
+		once   sync.Once
+	)
+	go func() {
+		select {
+		case <-ctx.Done():
+			closeFn()
+		case <-stopCh:
+		}
+	}()
+	return func() { once.Do(func() { close(stopCh) }) }
+}
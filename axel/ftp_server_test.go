@@ -0,0 +1,214 @@
+package axel
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"path"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// ftpServer is a minimal in-process ftp server stand-in for testing,
+// it serves the in-memory files by passive mode only
+type ftpServer struct {
+	ln     net.Listener
+	user   string            // login user, empty means anonymous is allowed
+	pass   string            // login password
+	home   string            // login directory, default /
+	files  map[string][]byte // absolute path -> file content
+	noRest bool              // disable the REST command
+
+	sync.Mutex     // protect the followings
+	retrs      int // nb of RETR commands
+}
+
+func newFTPServer(files map[string][]byte) (*ftpServer, error) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return nil, err
+	}
+
+	s := &ftpServer{ln: ln, files: files}
+	go s.serve()
+	return s, nil
+}
+
+func (s *ftpServer) URL(path string) string {
+	return fmt.Sprintf("ftp://%s%s", s.ln.Addr().String(), path)
+}
+
+func (s *ftpServer) AuthURL(user, pass, path string) string {
+	return fmt.Sprintf("ftp://%s:%s@%s%s", user, pass, s.ln.Addr().String(), path)
+}
+
+func (s *ftpServer) Retrs() int {
+	s.Lock()
+	defer s.Unlock()
+	return s.retrs
+}
+
+func (s *ftpServer) Close() error {
+	return s.ln.Close()
+}
+
+func (s *ftpServer) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *ftpServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		r      = bufio.NewReader(conn)
+		user   string
+		logged bool
+		cwd    string
+		offset int64
+		pasvln net.Listener
+	)
+	defer func() {
+		if pasvln != nil {
+			pasvln.Close()
+		}
+	}()
+
+	reply := func(code int, msg string) {
+		fmt.Fprintf(conn, "%d %s\r\n", code, msg)
+	}
+
+	// abs resolve the path relative to the working directory
+	abs := func(name string) string {
+		if strings.HasPrefix(name, "/") {
+			return path.Clean(name)
+		}
+		return path.Join(cwd, name)
+	}
+
+	reply(220, "welcome")
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+
+		var (
+			fields = strings.SplitN(strings.TrimSpace(line), " ", 2)
+			cmd    = strings.ToUpper(fields[0])
+			arg    string
+		)
+		if len(fields) > 1 {
+			arg = fields[1]
+		}
+
+		if !logged && cmd != "USER" && cmd != "PASS" && cmd != "QUIT" {
+			reply(530, "not logged in")
+			continue
+		}
+
+		switch cmd {
+		case "USER":
+			user = arg
+			reply(331, "password required")
+
+		case "PASS":
+			if s.user == "" && user == "anonymous" || user == s.user && arg == s.pass {
+				logged, cwd = true, s.home
+				if cwd == "" {
+					cwd = "/"
+				}
+				reply(230, "logged in")
+			} else {
+				reply(530, "login incorrect")
+			}
+
+		case "TYPE":
+			reply(200, "type set")
+
+		case "CWD":
+			dir, found := abs(arg), false
+			for name := range s.files {
+				found = found || strings.HasPrefix(name, strings.TrimSuffix(dir, "/")+"/")
+			}
+			if !found {
+				reply(550, "no such directory")
+				continue
+			}
+			cwd = dir
+			reply(250, "directory changed")
+
+		case "SIZE":
+			if data, ok := s.files[abs(arg)]; ok {
+				reply(213, strconv.Itoa(len(data)))
+			} else {
+				reply(550, "no such file")
+			}
+
+		case "MDTM":
+			if _, ok := s.files[abs(arg)]; ok {
+				reply(213, "20200723000000")
+			} else {
+				reply(550, "no such file")
+			}
+
+		case "REST":
+			if s.noRest {
+				reply(502, "not implemented")
+				continue
+			}
+			offset, _ = strconv.ParseInt(arg, 10, 64)
+			reply(350, "restarting")
+
+		case "EPSV":
+			if pasvln, err = net.Listen("tcp", "127.0.0.1:0"); err != nil {
+				reply(425, err.Error())
+				continue
+			}
+			reply(229, fmt.Sprintf("Entering Extended Passive Mode (|||%d|)", pasvln.Addr().(*net.TCPAddr).Port))
+
+		case "RETR":
+			data, ok := s.files[abs(arg)]
+			if !ok || pasvln == nil {
+				reply(550, "no such file")
+				continue
+			}
+			if offset > int64(len(data)) {
+				offset = int64(len(data))
+			}
+
+			s.Lock()
+			s.retrs++
+			s.Unlock()
+
+			reply(150, "opening data connection")
+			dconn, err := pasvln.Accept()
+			if err != nil {
+				reply(425, err.Error())
+				continue
+			}
+			_, err = dconn.Write(data[offset:])
+			dconn.Close()
+			pasvln.Close()
+			pasvln, offset = nil, 0
+			if err != nil {
+				reply(426, "transfer aborted")
+				continue
+			}
+			reply(226, "transfer complete")
+
+		case "QUIT":
+			reply(221, "bye")
+			return
+
+		default:
+			reply(502, "not implemented")
+		}
+	}
+}
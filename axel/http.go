@@ -1,236 +1,222 @@
 package axel
 
 import (
+	"context"
 	"crypto/tls"
-	"errors"
+	"crypto/x509"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
-	"os"
-	"path"
-	"path/filepath"
-	"runtime"
+	"net/url"
 	"strings"
-	"sync"
 	"time"
 )
 
-type httpAxel struct {
-	// options
-	remoteURL string // remote url
-	save      string // local save path
-	conn      int    // nb of connections, note: maybe reset as 1 if not support partial download
-
-	// http client
-	client *http.Client // http(s) client, FIXME prevent potential leaks after dozens of callings ??
-
-	// download runtime fields
-	startAt     time.Time  // start time
-	totalSize   int64      // total size
-	chunkSize   int64      // chunk size
-	supportPart bool       // support partial download
-	chunksDir   string     // chunks temporarily save dir
-	chunkErrs   []string   // held chunk errors  list
-	ckerrmux    sync.Mutex // protect above list
-	wg          sync.WaitGroup
+// httpBackend is the http & https backend of the downloader
+type httpBackend struct {
+	remoteURL string       // remote url
+	client    *http.Client // http(s) client, FIXME prevent potential leaks after dozens of callings ??
+	opts      *HTTPOptions // http options, headers & auth are set on each request
+
+	// the remote file's size & validator recorded by probe, so that the
+	// remote file changed during the download is detected by the ranged requests
+	size    int64
+	ifRange string
 }
 
-func newHTTPAxel(remoteURL, save string, conn int, connTimeout time.Duration) *httpAxel {
-	// set up default parameters
-	if conn <= 0 {
-		conn = runtime.NumCPU() * 2
+func newHTTPBackend(remoteURL string, connTimeout time.Duration, opts *HTTPOptions) (*httpBackend, error) {
+	if opts == nil {
+		opts = &HTTPOptions{}
 	}
-	if save == "" {
-		save = filepath.Base(remoteURL)
+
+	transport, err := opts.transport(connTimeout)
+	if err != nil {
+		return nil, err
 	}
 
-	return &httpAxel{
+	return &httpBackend{
 		remoteURL: remoteURL,
-		save:      save,
-		conn:      conn,
-		client: &http.Client{
-			Transport: &http.Transport{
-				Dial: func(network, addr string) (net.Conn, error) {
-					return net.DialTimeout(network, addr, connTimeout) // with user given connection timeout
-				},
-				ResponseHeaderTimeout: time.Second * 20,
-				TLSClientConfig: &tls.Config{
-					InsecureSkipVerify: true,
-				},
-			},
-		},
-		startAt: time.Now(),
-	}
+		client:    &http.Client{Transport: transport},
+		opts:      opts,
+		size:      -1,
+	}, nil
 }
 
-// Download implement the Axel interface
-func (a *httpAxel) Download() error {
-	// if save path exists, return conflicts
-	if _, err := os.Stat(a.save); err == nil {
-		return fmt.Errorf("conflicts, save path [%s] already exists", a.save)
-	}
-
-	// get the header & size
-	// prepare for the chunk size
-	resp, err := a.client.Get(a.remoteURL)
-	if err != nil {
-		return err
+// transport build the http transport by the proxy & tls options
+func (o *HTTPOptions) transport(connTimeout time.Duration) (*http.Transport, error) {
+	tlsConfig := &tls.Config{
+		InsecureSkipVerify: o.InsecureSkipVerify,
 	}
-	defer resp.Body.Close()
 
-	// return if not http status 200
-	if code := resp.StatusCode; code != http.StatusOK {
-		return fmt.Errorf("%d - %s", code, http.StatusText(code))
+	if o.CAFile != "" {
+		bs, err := ioutil.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(bs) {
+			return nil, fmt.Errorf("no certificates found in CA file [%s]", o.CAFile)
+		}
+		tlsConfig.RootCAs = pool
 	}
 
-	// detect total size & partial support
-	// note: reset conn=1 if total size unknown
-	// note: reset conn=1 if not supported partial download
-	a.totalSize = resp.ContentLength
-	a.supportPart = resp.Header.Get("Accept-Ranges") != ""
-	if a.totalSize <= 1 || !a.supportPart {
-		a.conn = 1
+	if o.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
 	}
 
-	// directly download and save
-	if a.conn == 1 {
-		return a.directSave(resp.Body)
+	proxy := http.ProxyFromEnvironment
+	if o.Proxy != "" {
+		u, err := url.Parse(o.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		proxy = http.ProxyURL(u) // note: socks5 proxy is supported by net/http as well
 	}
 
-	// partial downloa and save by concurrency
-	a.chunkSize = a.totalSize / int64(a.conn)
-	a.chunksDir = path.Join(filepath.Dir(a.save), filepath.Base(a.save)+".chunks")
-	defer os.RemoveAll(a.chunksDir)
-
-	// concurrency get each chunks
-	err = a.getAllChunks()
-	if err != nil {
-		return err
+	timeout := o.ResponseHeaderTimeout
+	if timeout <= 0 {
+		timeout = time.Second * 20
 	}
 
-	// join each pieces to the final save path
-	return a.join()
+	return &http.Transport{
+		Proxy:                 proxy,
+		DialContext:           (&net.Dialer{Timeout: connTimeout}).DialContext, // with user given connection timeout, aborted by the request ctx
+		ResponseHeaderTimeout: timeout,
+		TLSClientConfig:       tlsConfig,
+	}, nil
 }
 
-func (a *httpAxel) directSave(stream io.ReadCloser) error {
-	savefd, err := os.Create(a.save)
+// newRequest new a GET request with the user given headers, auth & cookies
+func (b *httpBackend) newRequest(ctx context.Context) (*http.Request, error) {
+	req, err := http.NewRequest("GET", b.remoteURL, nil)
 	if err != nil {
-		return err
+		return nil, err
 	}
-	defer savefd.Close()
-
-	_, err = io.Copy(savefd, stream)
-	return err
-}
-
-func (a *httpAxel) getAllChunks() error {
-	a.wg = sync.WaitGroup{}
-	a.chunkErrs = make([]string, 0, 0)
 
-	a.wg.Add(a.conn)
-	for i := 1; i <= a.conn; i++ {
-		go a.getChunk(i)
+	for key, vals := range b.opts.Header {
+		for _, val := range vals {
+			req.Header.Add(key, val)
+		}
 	}
-	a.wg.Wait()
-
-	if len(a.chunkErrs) != 0 {
-		return errors.New(strings.Join(a.chunkErrs, ","))
+	if host := b.opts.Header.Get("Host"); host != "" {
+		req.Host = host // note: the Host header is ignored by net/http
 	}
-	return nil
-}
 
-func (a *httpAxel) getChunk(idx int) {
-	defer a.wg.Done()
-
-	// create chunk directory
-	err := os.MkdirAll(a.chunksDir, os.FileMode(0755))
-	if err != nil {
-		a.addChunkErr(newChunkErr(idx, -1, -1, err))
-		return
+	switch {
+	case b.opts.Username != "":
+		req.SetBasicAuth(b.opts.Username, b.opts.Password)
+	case b.opts.BearerToken != "":
+		req.Header.Set("Authorization", "Bearer "+b.opts.BearerToken)
 	}
 
-	// construct & send range http request
-	var begin = int64((idx - 1)) * a.chunkSize
-	var end int64
-	if idx == a.conn {
-		end = a.totalSize
-	} else {
-		end = begin + a.chunkSize - 1
+	for _, cookie := range b.opts.Cookies {
+		req.AddCookie(cookie)
 	}
 
-	req, err := http.NewRequest("GET", a.remoteURL, nil)
+	return req.WithContext(ctx), nil
+}
+
+// probe implement the backend interface
+func (b *httpBackend) probe(ctx context.Context) (*remoteMeta, io.ReadCloser, error) {
+	// get the header & size
+	req, err := b.newRequest(ctx)
 	if err != nil {
-		a.addChunkErr(newChunkErr(idx, begin, end, err))
-		return
+		return nil, nil, err
 	}
-	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", begin, end))
-
-	resp, err := a.client.Do(req)
+	resp, err := b.client.Do(req)
 	if err != nil {
-		a.addChunkErr(newChunkErr(idx, begin, end, err))
-		return
+		return nil, nil, err
 	}
-	defer resp.Body.Close()
 
-	// save chunk files
-	fchunk := path.Join(a.chunksDir, fmt.Sprintf("%d", idx))
-	outfd, err := os.Create(fchunk)
-	if err != nil {
-		a.addChunkErr(newChunkErr(idx, begin, end, err))
-		return
+	// return if not http status 200
+	if code := resp.StatusCode; code != http.StatusOK {
+		resp.Body.Close()
+		return nil, nil, fmt.Errorf("%d - %s", code, http.StatusText(code))
 	}
-	defer outfd.Close()
 
-	_, err = io.Copy(outfd, resp.Body)
-	if err != nil {
-		a.addChunkErr(newChunkErr(idx, begin, end, err))
-		return
+	meta := &remoteMeta{
+		size:         resp.ContentLength,
+		supportPart:  resp.Header.Get("Accept-Ranges") == "bytes",
+		etag:         resp.Header.Get("ETag"),
+		lastModified: resp.Header.Get("Last-Modified"),
+		checksums:    parseDigestHeaders(resp.Header),
 	}
-}
 
-func (a *httpAxel) addChunkErr(err error) {
-	a.ckerrmux.Lock()
-	a.chunkErrs = append(a.chunkErrs, err.Error())
-	a.ckerrmux.Unlock()
+	// note: weak etag is not allowed by If-Range, use Last-Modified instead
+	b.size = meta.size
+	if meta.etag != "" && !strings.HasPrefix(meta.etag, "W/") {
+		b.ifRange = meta.etag
+	} else {
+		b.ifRange = meta.lastModified
+	}
+	return meta, resp.Body, nil
 }
 
-// join all chunk files together as the final save file by order
-func (a *httpAxel) join() error {
-	savefd, err := os.Create(a.save)
+// fetch implement the backend interface
+func (b *httpBackend) fetch(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+	// construct & send range http request
+	req, err := b.newRequest(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	expect := http.StatusOK
+	if start > 0 || end >= 0 {
+		expect = http.StatusPartialContent
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-%s", start, rangeEnd(end)))
+		if b.ifRange != "" {
+			req.Header.Set("If-Range", b.ifRange) // the whole changed file is responded with 200
+		}
 	}
-	defer savefd.Close()
 
-	for i := 1; i <= a.conn; i++ {
-		fchunk := path.Join(a.chunksDir, fmt.Sprintf("%d", i))
-		ckfd, err := os.Open(fchunk)
-		if err != nil {
-			return err
-		}
-		defer ckfd.Close()
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
 
-		_, err = io.Copy(savefd, ckfd)
-		if err != nil {
-			return err
+	// the server must respect our range request, otherwise the chunk file is broken
+	if code := resp.StatusCode; code != expect {
+		resp.Body.Close()
+		return nil, fmt.Errorf("%d - %s", code, http.StatusText(code))
+	}
+	if expect == http.StatusPartialContent {
+		if err := checkContentRange(resp.Header.Get("Content-Range"), start, b.size); err != nil {
+			resp.Body.Close()
+			return nil, err
 		}
 	}
 
-	return nil
-}
-
-type chunkErr struct {
-	idx   int
-	start int64
-	end   int64
-	err   error
+	return resp.Body, nil
 }
 
-func (e *chunkErr) Error() string {
-	return fmt.Sprintf("%d: fetch data chunk %d-%d error: %s", e.idx, e.start, e.end, e.err.Error())
+func rangeEnd(end int64) string {
+	if end < 0 {
+		return ""
+	}
+	return fmt.Sprintf("%d", end)
 }
 
-func newChunkErr(idx int, start, end int64, err error) *chunkErr {
-	return &chunkErr{idx, start, end, err}
+// checkContentRange check the Content-Range response header starts from
+// the requested position, and the complete length is the same as the probed
+// size if known, eg: bytes 100-199/1000
+func checkContentRange(val string, start, size int64) error {
+	var (
+		first, last int64
+		total       string
+	)
+	if _, err := fmt.Sscanf(val, "bytes %d-%d/%s", &first, &last, &total); err != nil {
+		return fmt.Errorf("invalid Content-Range %q: %v", val, err)
+	}
+	if first != start {
+		return fmt.Errorf("mismatched Content-Range %q, requested start %d", val, start)
+	}
+	if size >= 0 && total != "*" && total != fmt.Sprintf("%d", size) {
+		return fmt.Errorf("remote file changed: Content-Range %q, probed size %d", val, size)
+	}
+	return nil
 }
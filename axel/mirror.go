@@ -0,0 +1,355 @@
+package axel
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	// the interval to sample the throughput of each mirror stream
+	mirrorSampleInterval = time.Second
+
+	// the max penalty exponent of consecutive failures
+	maxMirrorFails = 10
+)
+
+// mirrorBackend is the backend to download the same file from several mirrors,
+// each fetching picks the mirror with the least load relative to its measured
+// throughput, so the chunks are spread in proportion to the throughput. the
+// mirror's load is doubled on each consecutive failure, so the chunks are moved
+// off a mirror once it starts failing.
+// a stream broken during transferring continues the rest bytes from the other
+// mirrors, so a failing mirror doesn't fail the chunk.
+type mirrorBackend struct {
+	sync.Mutex            // protect each mirror's runtime fields
+	mirrors     []*mirror // all of mirrors
+	supportPart bool      // the alive mirrors support partial download
+}
+
+type mirror struct {
+	url     string  // remote url
+	backend backend // protocol backend
+	active  int     // nb of active streams
+	speed   float64 // measured throughput of each stream, bytes/s, 0 means not measured yet
+	fails   int     // nb of consecutive failures
+}
+
+func newMirrorBackend(mirrors []*mirror) *mirrorBackend {
+	return &mirrorBackend{
+		mirrors: mirrors,
+	}
+}
+
+// probe implement the backend interface
+//
+// the unreachable mirrors are dropped, all of the rest mirrors must report
+// the same size, and the same ETag if present.
+func (m *mirrorBackend) probe(ctx context.Context) (*remoteMeta, io.ReadCloser, error) {
+	var (
+		metas = make([]*remoteMeta, len(m.mirrors))
+		errs  = make([]error, len(m.mirrors))
+		wg    sync.WaitGroup
+	)
+
+	wg.Add(len(m.mirrors))
+	for i, mr := range m.mirrors {
+		go func(i int, mr *mirror) {
+			defer wg.Done()
+			meta, stream, err := mr.backend.probe(ctx)
+			if stream != nil {
+				stream.Close()
+			}
+			metas[i], errs[i] = meta, err
+		}(i, mr)
+	}
+	wg.Wait()
+
+	var (
+		alive  = make([]*mirror, 0, len(m.mirrors))
+		metaOf = make(map[*mirror]*remoteMeta)
+		msgs   = make([]string, 0)
+	)
+	for i, mr := range m.mirrors {
+		if errs[i] != nil {
+			msgs = append(msgs, fmt.Sprintf("%s: %v", mr.url, errs[i]))
+			continue
+		}
+		alive = append(alive, mr)
+		metaOf[mr] = metas[i]
+	}
+	if len(alive) == 0 {
+		return nil, nil, errors.New(strings.Join(msgs, "; "))
+	}
+
+	meta, err := m.mergeMeta(alive, metaOf)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	// drop the mirrors not support partial download if others do
+	if meta.supportPart {
+		supported := make([]*mirror, 0, len(alive))
+		for _, mr := range alive {
+			if metaOf[mr].supportPart {
+				supported = append(supported, mr)
+			}
+		}
+		alive = supported
+	}
+
+	m.Lock()
+	m.mirrors = alive
+	m.supportPart = meta.supportPart
+	m.Unlock()
+
+	return meta, nil, nil
+}
+
+// mergeMeta verify the mirrors are serving the same file and merge their meta
+func (m *mirrorBackend) mergeMeta(mirrors []*mirror, metaOf map[*mirror]*remoteMeta) (*remoteMeta, error) {
+	var (
+		first = metaOf[mirrors[0]]
+		meta  = &remoteMeta{
+			size:         first.size,
+			lastModified: first.lastModified,
+		}
+		etagFrom string
+	)
+
+	for _, mr := range mirrors {
+		mm := metaOf[mr]
+
+		if mm.size != meta.size {
+			return nil, fmt.Errorf("%v: size %d (%s) != %d (%s)", ErrMirrorsMismatch, meta.size, mirrors[0].url, mm.size, mr.url)
+		}
+
+		if mm.etag != "" {
+			if meta.etag != "" && mm.etag != meta.etag {
+				return nil, fmt.Errorf("%v: etag %s (%s) != %s (%s)", ErrMirrorsMismatch, meta.etag, etagFrom, mm.etag, mr.url)
+			}
+			meta.etag, etagFrom = mm.etag, mr.url
+		}
+
+		// the mirrors' modification time may differ, only used as validator if the same
+		if mm.lastModified != meta.lastModified {
+			meta.lastModified = ""
+		}
+
+		meta.supportPart = meta.supportPart || mm.supportPart
+
+		// the checksums with the same algorithm must be the same
+		for _, sum := range mm.checksums {
+			for _, prev := range meta.checksums {
+				if prev.algo == sum.algo && prev.sum != sum.sum {
+					return nil, fmt.Errorf("%v: %s %s != %s (%s)", ErrMirrorsMismatch, sum.algo, prev.sum, sum.sum, mr.url)
+				}
+			}
+			meta.checksums = append(meta.checksums, sum)
+		}
+	}
+
+	return meta, nil
+}
+
+// fetch implement the backend interface
+//
+// try the mirrors by the order of preference, until one of them succeed.
+func (m *mirrorBackend) fetch(ctx context.Context, start, end int64) (io.ReadCloser, error) {
+	s := &mirrorStream{
+		ctx:   ctx,
+		m:     m,
+		start: start,
+		end:   end,
+		tried: make(map[*mirror]bool),
+	}
+	if err := s.open(nil); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// pick select the mirror with the least load relative to its throughput,
+// the load is the active streams (include the new one), and doubled on each
+// consecutive failure.
+// the not measured mirror is treated as the fastest one, so it gets measured soon.
+func (m *mirrorBackend) pick(excludes map[*mirror]bool) *mirror {
+	m.Lock()
+	defer m.Unlock()
+
+	var fastest float64
+	for _, mr := range m.mirrors {
+		if mr.speed > fastest {
+			fastest = mr.speed
+		}
+	}
+	if fastest == 0 {
+		fastest = 1
+	}
+
+	var (
+		best      *mirror
+		bestScore float64
+	)
+	for _, mr := range m.mirrors {
+		if excludes[mr] {
+			continue
+		}
+
+		speed := mr.speed
+		if speed == 0 {
+			speed = fastest
+		}
+		fails := mr.fails
+		if fails > maxMirrorFails {
+			fails = maxMirrorFails
+		}
+
+		score := float64(mr.active+1) * float64(int(1)<<uint(fails)) / speed
+		if best == nil || score < bestScore {
+			best, bestScore = mr, score
+		}
+	}
+
+	if best != nil {
+		best.active++
+	}
+	return best
+}
+
+// sample record the measured throughput of a stream of the mirror
+func (m *mirrorBackend) sample(mr *mirror, speed float64) {
+	m.Lock()
+	defer m.Unlock()
+
+	if mr.speed == 0 {
+		mr.speed = speed
+	} else {
+		mr.speed = mr.speed*0.7 + speed*0.3
+	}
+}
+
+// done release a stream of the mirror, any error counts a failure of the mirror,
+// only a success resets the failures. the stream aborted by the ctx is neither.
+func (m *mirrorBackend) done(mr *mirror, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	mr.active--
+	switch err {
+	case nil:
+		mr.fails = 0
+	case context.Canceled, context.DeadlineExceeded:
+	default:
+		mr.fails++
+	}
+}
+
+// mirrorStream measures the throughput of the mirror stream, and reports the
+// mirror's failure on reading error, then continues the rest of the range from
+// the mirrors not tried yet.
+type mirrorStream struct {
+	ctx        context.Context
+	m          *mirrorBackend
+	start, end int64            // the rest range to fetch, end -1 means to the end of file
+	tried      map[*mirror]bool // the mirrors tried by this stream
+	msgs       []string         // the errors of the tried mirrors
+
+	r        io.ReadCloser
+	mirror   *mirror   // current mirror, nil once all of mirrors failed
+	err      error     // the error once all of mirrors failed
+	sampleAt time.Time // the time of last sample
+	sampled  int64     // bytes read since last sample
+}
+
+// open try the untried mirrors by the order of preference to fetch the rest
+// range, until one of them succeed. the failed mirror is released with err.
+func (s *mirrorStream) open(err error) error {
+	if s.mirror != nil {
+		s.m.done(s.mirror, err)
+		s.r.Close()
+		s.msgs = append(s.msgs, fmt.Sprintf("%s: %v", s.mirror.url, err))
+		s.r, s.mirror = nil, nil
+
+		if s.end >= 0 && s.start > s.end {
+			return io.EOF
+		}
+		// can't continue from the middle without partial download
+		s.m.Lock()
+		supportPart := s.m.supportPart
+		s.m.Unlock()
+		if !supportPart && s.start > 0 {
+			return err
+		}
+	}
+
+	for s.ctx.Err() == nil {
+		mr := s.m.pick(s.tried)
+		if mr == nil {
+			return errors.New(strings.Join(s.msgs, "; "))
+		}
+		s.tried[mr] = true
+
+		stream, err := mr.backend.fetch(s.ctx, s.start, s.end)
+		if err != nil {
+			s.m.done(mr, err)
+			s.msgs = append(s.msgs, fmt.Sprintf("%s: %v", mr.url, err))
+			continue
+		}
+
+		s.r, s.mirror = stream, mr
+		s.sampleAt, s.sampled = time.Now(), 0
+		return nil
+	}
+
+	return s.ctx.Err()
+}
+
+func (s *mirrorStream) Read(p []byte) (int, error) {
+	if s.mirror == nil {
+		return 0, s.err
+	}
+
+	n, err := s.r.Read(p)
+	s.start += int64(n)
+
+	// the stream ends before the range's end is a short read of the mirror
+	if err == io.EOF && s.end >= 0 && s.start <= s.end {
+		err = io.ErrUnexpectedEOF
+	}
+
+	// note: sample at the EOF as well unless too few bytes to measure
+	s.sampled += int64(n)
+	if d := time.Since(s.sampleAt); d >= mirrorSampleInterval || err == io.EOF && s.sampled >= 64*1024 {
+		s.m.sample(s.mirror, float64(s.sampled)/d.Seconds())
+		s.sampleAt, s.sampled = time.Now(), 0
+	}
+
+	// switch to the other mirror, the reader continues with the rest bytes
+	// note: the reading error caused by the ctx is not the mirror's failure
+	if err != nil && err != io.EOF {
+		if ctxErr := s.ctx.Err(); ctxErr != nil {
+			err = ctxErr
+		}
+		if s.err = s.open(err); s.err == nil {
+			return n, nil
+		}
+		return n, s.err
+	}
+	return n, err
+}
+
+// Close release the current mirror, the reading errors are reported on
+// switching the mirrors already, so it's a success of the mirror unless
+// the stream is aborted by the ctx.
+func (s *mirrorStream) Close() error {
+	if s.mirror == nil {
+		return nil
+	}
+	s.m.done(s.mirror, s.ctx.Err())
+	return s.r.Close()
+}
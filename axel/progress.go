@@ -0,0 +1,94 @@
+package axel
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Progress is a snapshot of the download progress
+type Progress struct {
+	Total    int64            `json:"total"`     // total bytes, -1 means unknown
+	Received int64            `json:"received"`  // received bytes, including the resumed bytes
+	Elapsed  time.Duration    `json:"elapsed"`   // elapsed time since download start
+	Speed    float64          `json:"speed"`     // instantaneous speed in the recent seconds, bytes/s
+	AvgSpeed float64          `json:"avg_speed"` // average speed since download start, bytes/s
+	ETA      time.Duration    `json:"eta"`       // estimated time to finish, -1 means unknown
+	Chunks   []*ChunkProgress `json:"chunks"`    // each chunk's progress, empty if not downloaded by chunks
+}
+
+// Percent return the finished percentage, -1 means unknown
+func (p *Progress) Percent() float64 {
+	if p.Total <= 0 {
+		return -1
+	}
+	return float64(p.Received) * 100 / float64(p.Total)
+}
+
+// ChunkProgress is the progress of a chunk, each active chunk
+// is being fetched by one connection.
+type ChunkProgress struct {
+	Idx      int     `json:"idx"`      // chunk index
+	Start    int64   `json:"start"`    // range start
+	End      int64   `json:"end"`      // range end (inclusive)
+	Received int64   `json:"received"` // received bytes
+	Active   bool    `json:"active"`   // being fetched by a connection
+	Failed   bool    `json:"failed"`   // failed after all of retries
+	Speed    float64 `json:"speed"`    // average speed of current connection, bytes/s
+}
+
+// speedMeter measures the instantaneous speed by the samples in the recent window
+type speedMeter struct {
+	sync.Mutex
+	window  time.Duration
+	samples []speedSample
+}
+
+type speedSample struct {
+	at time.Time
+	n  int64
+}
+
+func newSpeedMeter(window time.Duration) *speedMeter {
+	return &speedMeter{
+		window:  window,
+		samples: make([]speedSample, 0),
+	}
+}
+
+// speed take a sample of current received bytes n, and return
+// the speed between the oldest sample in the window and now
+func (m *speedMeter) speed(n int64) float64 {
+	m.Lock()
+	defer m.Unlock()
+
+	now := time.Now()
+	if size := len(m.samples); size == 0 || now.Sub(m.samples[size-1].at) >= time.Millisecond*100 {
+		m.samples = append(m.samples, speedSample{now, n})
+	}
+
+	// shift outdated samples, keep at least two samples to measure
+	for len(m.samples) > 2 && now.Sub(m.samples[1].at) >= m.window {
+		m.samples = m.samples[1:]
+	}
+
+	oldest := m.samples[0]
+	secs := now.Sub(oldest.at).Seconds()
+	if secs <= 0 {
+		return 0
+	}
+	return float64(n-oldest.n) / secs
+}
+
+// countReader count the bytes read into n atomically
+type countReader struct {
+	r io.Reader
+	n *int64
+}
+
+func (cr *countReader) Read(p []byte) (int, error) {
+	n, err := cr.r.Read(p)
+	atomic.AddInt64(cr.n, int64(n))
+	return n, err
+}
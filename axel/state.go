@@ -0,0 +1,264 @@
+package axel
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// state is the persisted chunks state of a download, it records each chunk's
+// byte range & received bytes together with the remote validators, so that a
+// broken download could be resumed by re-requesting only the missing ranges.
+type state struct {
+	sync.Mutex   `json:"-"` // protect chunks
+	Size         int64      `json:"size"`          // remote total size
+	ETag         string     `json:"etag"`          // remote validator: ETag
+	LastModified string     `json:"last_modified"` // remote validator: Last-Modified
+	Chunks       []*chunk   `json:"chunks"`        // all of chunks
+}
+
+type chunk struct {
+	Idx     int   `json:"idx"`     // chunk index, start from 1
+	Start   int64 `json:"start"`   // range start
+	End     int64 `json:"end"`     // range end (inclusive)
+	Written int64 `json:"written"` // bytes already written
+
+	// runtime fields
+	active     bool      // being fetched by a connection
+	failed     bool      // failed after all of retries
+	inflight   int64     // bytes reserved by the writing, but not written yet
+	activeAt   time.Time // the time of being fetched by a connection
+	activeBase int64     // the written bytes at the time of being fetched
+}
+
+func (c *chunk) size() int64 {
+	return c.End - c.Start + 1
+}
+
+func (c *chunk) remains() int64 {
+	return c.size() - c.Written
+}
+
+func (c *chunk) activate() {
+	c.active = true
+	c.activeAt = time.Now()
+	c.activeBase = c.Written
+}
+
+// progress return the chunk progress, speed is the average speed
+// since the chunk being fetched by current connection
+func (c *chunk) progress() *ChunkProgress {
+	cp := &ChunkProgress{
+		Idx:      c.Idx,
+		Start:    c.Start,
+		End:      c.End,
+		Received: c.Written,
+		Active:   c.active,
+		Failed:   c.failed,
+	}
+	if secs := time.Since(c.activeAt).Seconds(); c.active && secs > 0 {
+		cp.Speed = float64(c.Written-c.activeBase) / secs
+	}
+	return cp
+}
+
+func newState(size int64, etag, lastmod string, conn int) *state {
+	s := &state{
+		Size:         size,
+		ETag:         etag,
+		LastModified: lastmod,
+		Chunks:       make([]*chunk, 0, conn),
+	}
+
+	// split the total size into conn chunks, the last chunk takes the tail
+	chunkSize := size / int64(conn)
+	for i := 1; i <= conn; i++ {
+		c := &chunk{Idx: i, Start: int64(i-1) * chunkSize}
+		if i == conn {
+			c.End = size - 1
+		} else {
+			c.End = c.Start + chunkSize - 1
+		}
+		s.Chunks = append(s.Chunks, c)
+	}
+
+	return s
+}
+
+func loadState(path string) (*state, error) {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var s *state
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return nil, fmt.Errorf("corrupted state file [%s]: %v", path, err)
+	}
+	if s == nil || len(s.Chunks) == 0 {
+		return nil, fmt.Errorf("corrupted state file [%s]: no chunks", path)
+	}
+	if err := s.check(); err != nil {
+		return nil, fmt.Errorf("corrupted state file [%s]: %v", path, err)
+	}
+	return s, nil
+}
+
+// check the chunks tile [0, Size) contiguously without gaps or overlaps,
+// and the written bytes of each chunk are within the chunk, otherwise
+// resuming would skip some ranges and produce a corrupted file silently.
+func (s *state) check() error {
+	chunks := make([]*chunk, len(s.Chunks))
+	copy(chunks, s.Chunks)
+	sort.Slice(chunks, func(i, j int) bool { return chunks[i].Start < chunks[j].Start })
+
+	var next int64
+	for _, c := range chunks {
+		if c.Start != next {
+			return fmt.Errorf("chunk %d starts at %d, expect %d", c.Idx, c.Start, next)
+		}
+		if c.End < c.Start {
+			return fmt.Errorf("chunk %d has invalid range %d-%d", c.Idx, c.Start, c.End)
+		}
+		if c.Written < 0 || c.Written > c.size() {
+			return fmt.Errorf("chunk %d written %d out of range %d-%d", c.Idx, c.Written, c.Start, c.End)
+		}
+		next = c.End + 1
+	}
+	if next != s.Size {
+		return fmt.Errorf("chunks end at %d, expect %d", next, s.Size)
+	}
+	return nil
+}
+
+// save write the state file by rename, so a crash during saving
+// won't leave a half written state file.
+// the sync is called after the snapshot of the state and before writing
+// the state file, so that the recorded written bytes are durable.
+func (s *state) save(path string, sync func() error) error {
+	s.Lock()
+	bs, err := json.Marshal(s)
+	s.Unlock()
+	if err != nil {
+		return err
+	}
+
+	if err := sync(); err != nil {
+		return err
+	}
+
+	tmp := path + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, os.FileMode(0644)); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// validate check the remote file is still the same one as recorded,
+// any validator changes means the chunks we have are stale
+func (s *state) validate(size int64, etag, lastmod string) error {
+	if s.Size != size {
+		return fmt.Errorf("%v: size %d -> %d", ErrRemoteChanged, s.Size, size)
+	}
+	if s.ETag != etag {
+		return fmt.Errorf("%v: etag %q -> %q", ErrRemoteChanged, s.ETag, etag)
+	}
+	if s.LastModified != lastmod {
+		return fmt.Errorf("%v: last modified %q -> %q", ErrRemoteChanged, s.LastModified, lastmod)
+	}
+	return nil
+}
+
+// next pick up a pending chunk to fetch, if no more pending chunks, split
+// the largest in-flight chunk and take over the tail half of it, so a slow
+// connection won't dominate the total time.
+// nil means nothing left to do.
+func (s *state) next(minSplit int64) *chunk {
+	s.Lock()
+	defer s.Unlock()
+
+	var largest *chunk
+	for _, c := range s.Chunks {
+		if c.failed || c.remains() <= 0 {
+			continue
+		}
+		if !c.active {
+			c.activate()
+			return c
+		}
+		if largest == nil || c.remains()-c.inflight > largest.remains()-largest.inflight {
+			largest = c
+		}
+	}
+
+	if largest == nil {
+		return nil
+	}
+	left := largest.remains() - largest.inflight
+	if left < minSplit*2 {
+		return nil
+	}
+
+	stolen := &chunk{
+		Idx:   len(s.Chunks) + 1,
+		Start: largest.End - left/2 + 1,
+		End:   largest.End,
+	}
+	stolen.activate()
+	largest.End = stolen.Start - 1
+	s.Chunks = append(s.Chunks, stolen)
+	return stolen
+}
+
+// release mark the chunk is not being fetched any more
+func (s *state) release(c *chunk, failed bool) {
+	s.Lock()
+	c.active = false
+	c.failed = failed
+	s.Unlock()
+}
+
+// progress return the written bytes and the current end of the chunk
+func (s *state) progress(c *chunk) (int64, int64) {
+	s.Lock()
+	defer s.Unlock()
+	return c.Written, c.End
+}
+
+// reserve reserve at most n bytes to be written on the chunk,
+// the returned value maybe less than n if reached the chunk's end
+func (s *state) reserve(c *chunk, n int64) int64 {
+	s.Lock()
+	defer s.Unlock()
+
+	if left := c.remains(); n > left {
+		n = left
+	}
+	c.inflight = n
+	return n
+}
+
+// incomplete return the first chunk not received completely, nil if none
+func (s *state) incomplete() *chunk {
+	s.Lock()
+	defer s.Unlock()
+
+	for _, c := range s.Chunks {
+		if c.remains() != 0 {
+			return c
+		}
+	}
+	return nil
+}
+
+// commit record n bytes written on the chunk
+func (s *state) commit(c *chunk, n int64) {
+	s.Lock()
+	c.Written += n
+	c.inflight = 0
+	s.Unlock()
+}
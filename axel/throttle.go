@@ -0,0 +1,61 @@
+package axel
+
+import (
+	"context"
+	"io"
+	"time"
+
+	rate "../rate-limit"
+)
+
+var (
+	// each token of the speed limiters stands for a block of bytes
+	throttleBlock = 4 * 1024
+)
+
+// newSpeedLimiter new a limiter of bytesPerSec, each token stands for a block of bytes.
+//
+// note: the limiter allows all of the tokens in the window to be taken at once,
+// so the window is shortened to about 100ms to smooth the bursts if possible,
+// and sized by the exact blocks in it, so the rate is not truncated to the blocks.
+func newSpeedLimiter(bytesPerSec int) rate.Limiter {
+	blocks := bytesPerSec / throttleBlock / 10
+	if blocks < 1 {
+		blocks = 1
+	}
+	window := time.Second * time.Duration(blocks*throttleBlock) / time.Duration(bytesPerSec)
+	return rate.NewLimiter(window, blocks)
+}
+
+// throttleReader limits the reading speed by the limiters, each read
+// takes one token from every limiter and reads at most one block.
+type throttleReader struct {
+	ctx      context.Context
+	r        io.Reader
+	limiters []rate.Limiter
+}
+
+func newThrottleReader(ctx context.Context, r io.Reader, limiters ...rate.Limiter) io.Reader {
+	ls := make([]rate.Limiter, 0, len(limiters))
+	for _, l := range limiters {
+		if l != nil {
+			ls = append(ls, l)
+		}
+	}
+	if len(ls) == 0 {
+		return r
+	}
+	return &throttleReader{ctx: ctx, r: r, limiters: ls}
+}
+
+func (t *throttleReader) Read(p []byte) (int, error) {
+	if len(p) > throttleBlock {
+		p = p[:throttleBlock]
+	}
+	for _, l := range t.limiters {
+		if err := l.Wait(t.ctx); err != nil {
+			return 0, err
+		}
+	}
+	return t.r.Read(p)
+}
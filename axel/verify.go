@@ -0,0 +1,132 @@
+package axel
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+)
+
+// checksum is an expected hash of the final file
+type checksum struct {
+	algo string // md5, sha1, sha256
+	sum  string // hex encoded, lower case
+	from string // where the checksum comes from
+}
+
+var hashers = map[string]func() hash.Hash{
+	"md5":    md5.New,
+	"sha1":   sha1.New,
+	"sha256": sha256.New,
+}
+
+// normalizeAlgo normalize the hash algorithm name, eg: SHA-256 -> sha256
+func normalizeAlgo(algo string) string {
+	return strings.Replace(strings.ToLower(strings.TrimSpace(algo)), "-", "", -1)
+}
+
+// parseChecksum parse the user supplied checksum in format of `<algo>:<hex>`
+func parseChecksum(s string) (*checksum, error) {
+	fields := strings.SplitN(s, ":", 2)
+	if len(fields) != 2 {
+		return nil, fmt.Errorf("invalid checksum %q, should be <algo>:<hex>", s)
+	}
+
+	algo := normalizeAlgo(fields[0])
+	newHash, ok := hashers[algo]
+	if !ok {
+		return nil, fmt.Errorf("invalid checksum %q, unsupported algorithm %s", s, fields[0])
+	}
+
+	sum := strings.ToLower(strings.TrimSpace(fields[1]))
+	if bs, err := hex.DecodeString(sum); err != nil || len(bs) != newHash().Size() {
+		return nil, fmt.Errorf("invalid checksum %q, malformed hex sum", s)
+	}
+
+	return &checksum{algo: algo, sum: sum, from: "user"}, nil
+}
+
+// parseDigestHeaders parse the checksums from the http response headers:
+//
+//	Digest: SHA-256=X48E9qOokqqrvdts8nOJRJN3OWDUoyWxBf7kbu9DBPE=,MD5=...  (RFC 3230)
+//	Content-MD5: Q2hlY2sgSW50ZWdyaXR5IQ==                                  (RFC 1864)
+//
+// the unsupported or malformed ones are ignored
+func parseDigestHeaders(h http.Header) []*checksum {
+	sums := make([]*checksum, 0)
+
+	add := func(algo, b64, from string) {
+		bs, err := base64.StdEncoding.DecodeString(strings.TrimSpace(b64))
+		if err != nil {
+			return
+		}
+		newHash, ok := hashers[algo]
+		if !ok || len(bs) != newHash().Size() {
+			return
+		}
+		sums = append(sums, &checksum{algo: algo, sum: hex.EncodeToString(bs), from: from})
+	}
+
+	for _, val := range h["Digest"] {
+		for _, item := range strings.Split(val, ",") {
+			kv := strings.SplitN(item, "=", 2)
+			if len(kv) != 2 {
+				continue
+			}
+			algo := normalizeAlgo(kv[0])
+			if algo == "sha" { // SHA means SHA-1 in RFC 3230
+				algo = "sha1"
+			}
+			add(algo, kv[1], "Digest header")
+		}
+	}
+
+	if val := h.Get("Content-MD5"); val != "" {
+		add("md5", val, "Content-MD5 header")
+	}
+
+	return sums
+}
+
+// verifyFile verify the file against all of the checksums by one pass reading
+func verifyFile(path string, sums []*checksum) error {
+	if len(sums) == 0 {
+		return nil
+	}
+
+	fd, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	var (
+		hashes  = make(map[string]hash.Hash)
+		writers = make([]io.Writer, 0)
+	)
+	for _, sum := range sums {
+		if _, ok := hashes[sum.algo]; !ok {
+			h := hashers[sum.algo]()
+			hashes[sum.algo] = h
+			writers = append(writers, h)
+		}
+	}
+
+	if _, err := io.Copy(io.MultiWriter(writers...), fd); err != nil {
+		return err
+	}
+
+	for _, sum := range sums {
+		if got := hex.EncodeToString(hashes[sum.algo].Sum(nil)); got != sum.sum {
+			return fmt.Errorf("%v: %s %s expected by %s, got %s", ErrChecksumMismatch, sum.algo, sum.sum, sum.from, got)
+		}
+	}
+	return nil
+}
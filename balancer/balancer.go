@@ -2,6 +2,7 @@ package balancer
 
 import (
 	"math/rand"
+	"sync"
 	"time"
 )
 
@@ -19,6 +20,52 @@ func NewWeight() Balancer {
 	return new(weightBalancer)
 }
 
+// NewSmoothWeight is exported
+func NewSmoothWeight() Balancer {
+	return &swrrBalancer{
+		peers: make(map[Item]*swrrPeer),
+	}
+}
+
+// NewLeastConn is exported
+func NewLeastConn() FeedbackBalancer {
+	return &lcBalancer{newTracker()}
+}
+
+// NewP2C is exported
+func NewP2C() FeedbackBalancer {
+	return &p2cBalancer{newTracker()}
+}
+
+// NewPeakEWMA is exported
+func NewPeakEWMA() FeedbackBalancer {
+	return &ewmaBalancer{newTracker()}
+}
+
+// NewHealth is exported
+// wrap the balancer with the active health checks and the passive ejection,
+// Close must be called to stop the active checks once not used any more.
+func NewHealth(b Balancer, opts *HealthOptions) HealthBalancer {
+	return newHealthBalancer(b, opts)
+}
+
+// NewConsistentHash is exported
+// loadFactor > 0 enables the bounded loads, eg: 1.25 means each item accepts at
+// most 125% of the average in-flight requests (relative to its weight).
+func NewConsistentHash(loadFactor float64) HashBalancer {
+	if loadFactor < 0 {
+		loadFactor = 0
+	}
+	if loadFactor > 0 && loadFactor < 1 {
+		loadFactor = 1
+	}
+	return &chashBalancer{
+		loadFactor: loadFactor,
+		members:    make(map[Item]*ketamaMember),
+		loads:      make(map[Item]int),
+	}
+}
+
 //
 // interface define and implemention
 //
@@ -28,6 +75,31 @@ type Balancer interface {
 	Next([]Item) Item
 }
 
+// FeedbackBalancer is a balancer which tracks the in-flight requests and the
+// latency of each item, each item returned by Next must be reported by Done
+// once the request finished, with the latency and the error of the request.
+type FeedbackBalancer interface {
+	Balancer
+	Done(item Item, latency time.Duration, err error)
+}
+
+// HashBalancer is a key affine balancer, the same key is always mapped to the
+// same item unless the items changed (or the item is overloaded under bounded
+// loads), the Done is required only under bounded loads.
+type HashBalancer interface {
+	FeedbackBalancer
+	NextKey(key string, items []Item) Item
+}
+
+// HealthBalancer is a balancer never returns the unhealthy items, the item is
+// unhealthy if failed the active check, or ejected by the consecutive failures
+// reported by Done.
+type HealthBalancer interface {
+	FeedbackBalancer
+	Healthy(item Item) bool
+	Close() // stop the active checks
+}
+
 // Item is a generic item to be selected
 //
 // note: the Weight is no use for rrBalancer, only used for weightBalancer
@@ -37,12 +109,20 @@ type Item interface {
 	WeightN() int
 }
 
+// KeyItem is an Item with a unique & stable key, eg: the address, the consistent
+// hashing balancer places the items on the ring by their keys.
+type KeyItem interface {
+	Item
+	Key() string
+}
+
 // note: when using rrBalancer, the items slice Size & Order should be fixed
 //
 // if item adding / removing occured during multi Next calls,
 // the rrBalancer can't ensure each time the returned item is RRed
 type rrBalancer struct {
-	current int
+	sync.Mutex // protect current
+	current    int
 }
 
 func (b *rrBalancer) Next(items []Item) Item {
@@ -50,6 +130,9 @@ func (b *rrBalancer) Next(items []Item) Item {
 		return nil
 	}
 
+	b.Lock()
+	defer b.Unlock()
+
 	if b.current >= len(items) {
 		b.current = 0
 	}
@@ -69,11 +152,7 @@ func (b *weightBalancer) Next(items []Item) Item {
 	var wsum = int(0)
 	// caculate weight sum first (treat negative -> positive)
 	for _, item := range items {
-		val := item.WeightN()
-		if val < 0 {
-			val = -val
-		}
-		wsum += val
+		wsum += absWeight(item)
 	}
 
 	// if all of weight value equals 0, return nil
@@ -86,11 +165,21 @@ func (b *weightBalancer) Next(items []Item) Item {
 		randval = rand.Intn(wsum)
 		n       int
 	)
+	// note: must accumulate the same abs weights as the sum
 	for _, item := range items {
-		n += item.WeightN()
+		n += absWeight(item)
 		if n > randval {
 			return item
 		}
 	}
 	return nil
 }
+
+// absWeight return the item weight, the negative weight is treated as positive
+func absWeight(item Item) int {
+	w := item.WeightN()
+	if w < 0 {
+		w = -w
+	}
+	return w
+}
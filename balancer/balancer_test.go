@@ -0,0 +1,957 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math"
+	"math/rand"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+type balancerSuit struct{}
+
+var _ = check.Suite(new(balancerSuit))
+
+func TestBalancer(t *testing.T) {
+	check.TestingT(t)
+}
+
+type node struct {
+	id     string
+	weight int
+}
+
+func (n *node) WeightN() int {
+	return n.weight
+}
+
+func (n *node) String() string {
+	return n.id
+}
+
+func newNodes(weights ...int) []Item {
+	items := make([]Item, 0, len(weights))
+	for i, w := range weights {
+		items = append(items, &node{string(rune('a' + i)), w})
+	}
+	return items
+}
+
+// sequence return the ids of n selections
+func sequence(b Balancer, items []Item, n int) string {
+	ids := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		if next := b.Next(items); next != nil {
+			ids = append(ids, next.(*node).id)
+		} else {
+			ids = append(ids, "-")
+		}
+	}
+	return strings.Join(ids, "")
+}
+
+func (s *balancerSuit) TestSmoothWeight(c *check.C) {
+	b := NewSmoothWeight()
+
+	// the same sequence as nginx
+	nodes := newNodes(5, 1, 1)
+	c.Assert(sequence(b, nodes, 14), check.Equals, "aabacaaaabacaa")
+
+	// negative weight treated as positive, 0 means disabled
+	b = NewSmoothWeight()
+	nodes = newNodes(-2, 0, 1)
+	c.Assert(sequence(b, nodes, 6), check.Equals, "acaaca")
+
+	// all disabled
+	c.Assert(NewSmoothWeight().Next(newNodes(0, 0)), check.IsNil)
+	c.Assert(NewSmoothWeight().Next(nil), check.IsNil)
+}
+
+func (s *balancerSuit) TestSmoothWeightChangeItems(c *check.C) {
+	var (
+		b     = NewSmoothWeight()
+		nodes = newNodes(1, 1, 1)
+	)
+	c.Assert(sequence(b, nodes, 3), check.Equals, "abc")
+
+	// the rest items keep their current weights after removing
+	c.Assert(sequence(b, nodes[1:], 4), check.Equals, "bcbc")
+
+	// the added item joins the rotation
+	nodes = append(nodes[1:], &node{"d", 2})
+	c.Assert(sequence(b, nodes, 8), check.Equals, "dbcddbcd")
+	c.Assert(len(b.(*swrrBalancer).peers), check.Equals, 3)
+}
+
+func (s *balancerSuit) TestLeastConn(c *check.C) {
+	var (
+		b     = NewLeastConn()
+		nodes = newNodes(1, 1, 1)
+	)
+
+	// each item gets one in-flight request
+	c.Assert(sequence(b, nodes, 3), check.Matches, "(abc|bca|cab)")
+
+	// the released one is the least loaded
+	b.Done(nodes[1], time.Millisecond, nil)
+	c.Assert(b.Next(nodes), check.Equals, nodes[1])
+
+	// weighted by the weight, disabled by 0
+	b = NewLeastConn()
+	nodes = newNodes(2, 1, 0)
+	cnt := make(map[Item]int)
+	for i := 0; i < 30; i++ {
+		cnt[b.Next(nodes)]++
+	}
+	c.Assert(cnt[nodes[0]], check.Equals, 20)
+	c.Assert(cnt[nodes[1]], check.Equals, 10)
+	c.Assert(NewLeastConn().Next(newNodes(0)), check.IsNil)
+}
+
+func (s *balancerSuit) TestP2C(c *check.C) {
+	var (
+		b     = NewP2C()
+		nodes = newNodes(1, 1, 1)
+	)
+
+	// the stuck item gets no more requests
+	b.(*p2cBalancer).stats[nodes[0]] = &itemStats{inflight: 100}
+	cnt := make(map[Item]int)
+	for i := 0; i < 1000; i++ {
+		next := b.Next(nodes)
+		cnt[next]++
+		if next != nodes[0] {
+			b.Done(next, time.Millisecond, nil)
+		}
+	}
+	c.Assert(cnt[nodes[0]], check.Equals, 0)
+	c.Assert(cnt[nodes[1]] > 400 && cnt[nodes[2]] > 400, check.Equals, true)
+}
+
+func (s *balancerSuit) TestPeakEWMA(c *check.C) {
+	var (
+		b     = NewPeakEWMA()
+		nodes = newNodes(1, 1, 1)
+	)
+
+	latency := map[Item]time.Duration{
+		nodes[0]: time.Millisecond * 10,
+		nodes[1]: time.Millisecond * 50,
+		nodes[2]: time.Millisecond * 100,
+	}
+	cnt := make(map[Item]int)
+	for i := 0; i < 100; i++ {
+		next := b.Next(nodes)
+		cnt[next]++
+		b.Done(next, latency[next], nil)
+	}
+	c.Assert(cnt[nodes[0]] > 90, check.Equals, true)
+
+	// the fast failing item is routed away
+	b.Done(b.Next(nodes), 0, errors.New("connection refused"))
+	c.Assert(b.Next(nodes), check.Not(check.Equals), nodes[0])
+}
+
+func (s *balancerSuit) TestConsistentHash(c *check.C) {
+	var (
+		b     = NewConsistentHash(0)
+		nodes = newNodes(1, 1, 1, 1, 2)
+		keys  = make([]string, 10000)
+		owner = make(map[string]Item)
+		cnt   = make(map[Item]int)
+	)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		owner[keys[i]] = b.NextKey(keys[i], nodes)
+		cnt[owner[keys[i]]]++
+	}
+
+	// spread by the weights, ±20%
+	for _, n := range nodes {
+		expect := len(keys) * n.WeightN() / 6
+		c.Assert(cnt[n] > expect*8/10 && cnt[n] < expect*12/10, check.Equals, true, check.Commentf("%s: %d", n, cnt[n]))
+	}
+
+	// the same key is mapped to the same item
+	for _, key := range keys[:100] {
+		c.Assert(b.NextKey(key, nodes), check.Equals, owner[key])
+	}
+
+	// only the keys of the removed item are moved, except a few keys moved between
+	// the others once the removed item is pruned, as the weight shares changed
+	removed := nodes[2]
+	rest := append(append([]Item{}, nodes[:2]...), nodes[3:]...)
+	var shifted int
+	for _, key := range keys {
+		next := b.NextKey(key, rest)
+		c.Assert(next, check.Not(check.Equals), removed)
+		if owner[key] != removed && next != owner[key] {
+			shifted++
+		}
+	}
+	c.Assert(shifted < len(keys)*5/100, check.Equals, true, check.Commentf("shifted %d", shifted))
+
+	// only the added item takes over keys, except a few as above
+	added := append(append([]Item{}, nodes...), &node{"x", 1})
+	var moved int
+	shifted = 0
+	for _, key := range keys {
+		if next := b.NextKey(key, added); next == added[5] {
+			moved++
+		} else if next != owner[key] {
+			shifted++
+		}
+	}
+	c.Assert(moved > len(keys)/7*8/10 && moved < len(keys)/7*12/10, check.Equals, true, check.Commentf("moved %d", moved))
+	c.Assert(shifted < len(keys)*5/100, check.Equals, true, check.Commentf("shifted %d", shifted))
+
+	// the same weights never shift the keys between the others
+	b = NewConsistentHash(0)
+	nodes = newNodes(1, 1, 1, 1)
+	for _, key := range keys {
+		owner[key] = b.NextKey(key, nodes)
+	}
+	added = append(append([]Item{}, nodes...), &node{"x", 1})
+	for _, key := range keys {
+		if next := b.NextKey(key, added); next != owner[key] {
+			c.Assert(next, check.Equals, added[4])
+		}
+	}
+
+	c.Assert(b.NextKey("key", newNodes(0, 0)), check.IsNil)
+}
+
+// hostItem is an item keyed by itself on the ring
+type hostItem string
+
+func (h hostItem) WeightN() int {
+	return 1
+}
+
+// weightItem is an item without a stable key on the ring
+type weightItem struct {
+	weight int
+}
+
+func (w *weightItem) WeightN() int {
+	return w.weight
+}
+
+func (s *balancerSuit) TestConsistentHashKeys(c *check.C) {
+	// the ring size is independent of the weights' scale
+	small, large, nodes := NewConsistentHash(0), NewConsistentHash(0), newNodes(100, 1000)
+	small.NextKey("key", newNodes(1, 10))
+	large.NextKey("key", nodes)
+	c.Assert(large.(*chashBalancer).ring, check.HasLen, len(small.(*chashBalancer).ring))
+	c.Assert(len(large.(*chashBalancer).ring) <= ketamaReplicas*2*4, check.Equals, true)
+
+	// the keys are mapped by the items' keys, the same on another balancer (eg: process)
+	other, others := NewConsistentHash(0), newNodes(100, 1000)
+	for i := 0; i < 100; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		c.Assert(large.NextKey(key, nodes).(*node).id, check.Equals, other.NextKey(key, others).(*node).id)
+	}
+
+	// the string type item is keyed by itself, the items without a stable key are skipped
+	hosts := []Item{hostItem("10.0.0.1"), hostItem("10.0.0.2")}
+	c.Assert(NewConsistentHash(0).NextKey("key", hosts), check.Equals, NewConsistentHash(0).NextKey("key", hosts))
+	b := NewConsistentHash(0)
+	c.Assert(b.NextKey("key", []Item{&weightItem{1}}), check.IsNil)
+	for i := 0; i < 100; i++ {
+		c.Assert(b.NextKey(fmt.Sprintf("key-%d", i), []Item{&weightItem{1}, hosts[0]}), check.Equals, hosts[0])
+	}
+
+	// the KeyItem is keyed by Key()
+	u1, _ := NewUpstream("http://10.0.0.1", 1)
+	u2, _ := NewUpstream("http://10.0.0.2", 1)
+	c.Assert(itemKey(u1), check.Equals, "http://10.0.0.1")
+	c.Assert(NewConsistentHash(0).NextKey("key", []Item{u1, u2}).(*Upstream).Key(), check.Equals,
+		NewConsistentHash(0).NextKey("key", []Item{u2, u1}).(*Upstream).Key())
+}
+
+func (s *balancerSuit) TestConsistentHashSkewedWeights(c *check.C) {
+	// each enabled item owns a replica at least, however small its share is
+	var (
+		b     = NewConsistentHash(0)
+		nodes = []Item{&node{"heavy", 100}, &node{"light", 1}}
+	)
+	c.Assert(b.NextKey("k", nodes), check.NotNil)
+	c.Assert(b.NextKey("k", nodes[1:]), check.Equals, nodes[1])
+
+	// the light item is still selected once the heavy one ejected
+	hb := NewHealth(NewConsistentHash(0), &HealthOptions{MaxFails: 1, Backoff: time.Hour})
+	defer hb.Close()
+	hash := hb.(HashBalancer)
+	c.Assert(hash.NextKey("k", nodes), check.NotNil)
+	hb.Done(nodes[0], 0, errors.New("connection refused"))
+	c.Assert(hb.Healthy(nodes[0]), check.Equals, false)
+	for i := 0; i < 100; i++ {
+		c.Assert(hash.NextKey(fmt.Sprintf("key-%d", i), nodes), check.Equals, nodes[1])
+	}
+}
+
+func (s *balancerSuit) TestConsistentHashBoundedLoads(c *check.C) {
+	var (
+		b     = NewConsistentHash(1.25)
+		nodes = newNodes(1, 1, 1, 1)
+		cnt   = make(map[Item]int)
+	)
+
+	// the hot key overflows to the next items once its owner is full
+	owner := b.NextKey("hot", nodes)
+	b.Done(owner, 0, nil)
+	for i := 0; i < 100; i++ {
+		cnt[b.NextKey("hot", nodes)]++
+	}
+	for _, n := range nodes {
+		c.Assert(cnt[n] <= 32, check.Equals, true, check.Commentf("%s: %d", n, cnt[n]))
+	}
+	c.Assert(cnt[owner], check.Equals, 32)
+
+	// the owner takes the key back once its load released
+	for item, n := range cnt {
+		for i := 0; i < n; i++ {
+			b.Done(item, 0, nil)
+		}
+	}
+	c.Assert(b.NextKey("hot", nodes), check.Equals, owner)
+}
+
+func (s *balancerSuit) TestConsistentHashSubset(c *check.C) {
+	var (
+		b     = NewConsistentHash(0)
+		cb    = b.(*chashBalancer)
+		nodes = newNodes(1, 1, 1, 1)
+		rest  = nodes[1:]
+		keys  = make([]string, 1000)
+		owner = make(map[string]Item)
+	)
+	for i := range keys {
+		keys[i] = fmt.Sprintf("key-%d", i)
+		owner[keys[i]] = b.NextKey(keys[i], nodes)
+	}
+	ring := cb.ring
+	c.Assert(ring, check.HasLen, ketamaReplicas*4*4)
+
+	// the excluded item is skipped without rebuilding the ring, the same as a ring of the subset
+	fresh := NewConsistentHash(0)
+	for _, key := range keys {
+		c.Assert(b.NextKey(key, rest), check.Equals, fresh.NextKey(key, rest))
+	}
+	c.Assert(&cb.ring[0], check.Equals, &ring[0])
+
+	// the owners are back once the item is given again
+	for _, key := range keys {
+		c.Assert(b.NextKey(key, nodes), check.Equals, owner[key])
+	}
+	c.Assert(&cb.ring[0], check.Equals, &ring[0])
+
+	// the item not given for a while is removed from the ring, checked on each ketamaPruneCalls calls
+	for i := uint64(0); i < ketamaPruneCalls*2; i++ {
+		b.NextKey(keys[0], rest)
+	}
+	c.Assert(cb.ring, check.HasLen, ketamaReplicas*4*3)
+	c.Assert(cb.members[nodes[0]], check.IsNil)
+}
+
+func (s *balancerSuit) TestConsistentHashSubsetLoads(c *check.C) {
+	var (
+		b     = NewConsistentHash(1.25)
+		cb    = b.(*chashBalancer)
+		nodes = newNodes(1, 1, 1, 1)
+		taken = make([]Item, 0)
+	)
+	for i := 0; i < 8; i++ {
+		taken = append(taken, b.NextKey(fmt.Sprintf("key-%d", i), nodes))
+	}
+	loads := make(map[Item]int)
+	for item, n := range cb.loads {
+		loads[item] = n
+	}
+
+	// the loads of the excluded items are kept, and counted by the bounded loads
+	for _, item := range nodes {
+		var rest []Item
+		for _, other := range nodes {
+			if other != item {
+				rest = append(rest, other)
+			}
+		}
+		next := b.NextKey("hot", rest)
+		c.Assert(next, check.Not(check.Equals), item)
+		c.Assert(cb.loads[item], check.Equals, loads[item])
+		b.Done(next, 0, nil)
+	}
+	c.Assert(cb.loads, check.DeepEquals, loads)
+	c.Assert(cb.inflight, check.Equals, 8)
+
+	for _, item := range taken {
+		b.Done(item, 0, nil)
+	}
+	c.Assert(cb.loads, check.HasLen, 0)
+	c.Assert(cb.inflight, check.Equals, 0)
+}
+
+func (s *balancerSuit) TestHealthEjection(c *check.C) {
+	var (
+		nodes   = newNodes(1, 1, 1)
+		b       = NewHealth(NewRR(), &HealthOptions{MaxFails: 2, Backoff: time.Millisecond * 100})
+		errDown = errors.New("connection refused")
+	)
+	defer b.Close()
+
+	// ejected after 2 consecutive failures
+	b.Done(nodes[0], 0, errDown)
+	c.Assert(b.Healthy(nodes[0]), check.Equals, true)
+	b.Done(nodes[0], 0, errDown)
+	c.Assert(b.Healthy(nodes[0]), check.Equals, false)
+	c.Assert(sequence(b, nodes, 6), check.Equals, "bcbcbc")
+
+	// back after the backoff
+	time.Sleep(time.Millisecond * 120)
+	c.Assert(b.Healthy(nodes[0]), check.Equals, true)
+
+	// the backoff is doubled on the consecutive ejection
+	b.Done(nodes[0], 0, errDown)
+	b.Done(nodes[0], 0, errDown)
+	time.Sleep(time.Millisecond * 120)
+	c.Assert(b.Healthy(nodes[0]), check.Equals, false)
+	time.Sleep(time.Millisecond * 150)
+	c.Assert(b.Healthy(nodes[0]), check.Equals, true)
+
+	// all ejected
+	for _, n := range nodes {
+		b.Done(n, 0, errDown)
+		b.Done(n, 0, errDown)
+	}
+	c.Assert(b.Next(nodes), check.IsNil)
+}
+
+func (s *balancerSuit) TestHealthCheck(c *check.C) {
+	var (
+		nodes = newNodes(1, 1)
+		addrs = make(map[Item]string)
+		lns   []net.Listener
+	)
+	for _, n := range nodes {
+		ln, err := net.Listen("tcp", "127.0.0.1:0")
+		c.Assert(err, check.IsNil)
+		defer ln.Close()
+		lns = append(lns, ln)
+		addrs[n] = ln.Addr().String()
+	}
+
+	b := NewHealth(NewRR(), &HealthOptions{
+		Check:    TCPCheck(func(item Item) string { return addrs[item] }),
+		Interval: time.Millisecond * 20,
+	})
+	defer b.Close()
+	c.Assert(sequence(b, nodes, 4), check.Equals, "abab")
+
+	// the down item is never returned
+	lns[0].Close()
+	time.Sleep(time.Millisecond * 100)
+	c.Assert(b.Healthy(nodes[0]), check.Equals, false)
+	c.Assert(sequence(b, nodes, 4), check.Equals, "bbbb")
+
+	// HTTP check
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/health" {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+	}))
+	defer srv.Close()
+	httpCheck := HTTPCheck(func(item Item) string { return srv.URL + "/" + item.(*node).id })
+	c.Assert(httpCheck(context.Background(), &node{"health", 1}), check.IsNil)
+	c.Assert(httpCheck(context.Background(), &node{"other", 1}), check.ErrorMatches, "503 - Service Unavailable")
+}
+
+func (s *balancerSuit) TestHealthSubsets(c *check.C) {
+	var (
+		nodes   = newNodes(1, 1, 1)
+		checked = make(map[Item]int)
+		mux     sync.Mutex // protect checked
+		errDown = errors.New("connection refused")
+	)
+	hb := newHealthBalancer(NewRR(), &HealthOptions{
+		Check: func(ctx context.Context, item Item) error {
+			mux.Lock()
+			checked[item]++
+			mux.Unlock()
+			return nil
+		},
+		Interval: time.Hour, // checked manually
+		MaxFails: 3,
+	})
+	defer hb.Close()
+
+	// the retries exclude the failing item, interleaved with the active checks
+	for i := 0; i < 3; i++ {
+		hb.Next(nodes)
+		hb.Next([]Item{nodes[0], nodes[2]})
+		hb.Done(nodes[1], 0, errDown)
+		hb.checkAll()
+	}
+
+	// all of the items are checked, though the latest call is a subset
+	mux.Lock()
+	for _, n := range nodes {
+		c.Assert(checked[n], check.Equals, 3, check.Commentf("%s", n))
+	}
+	mux.Unlock()
+
+	// the consecutive failures are kept through the sweeps
+	c.Assert(hb.Healthy(nodes[1]), check.Equals, false)
+
+	// the item not given for several intervals is neither checked nor tracked
+	hb.Done(nodes[2], 0, errDown)
+	hb.Lock()
+	hb.seen[nodes[2]] = time.Now().Add(-hb.opts.Interval * time.Duration(healthSeenIntervals+1))
+	hb.Unlock()
+	hb.checkAll()
+	mux.Lock()
+	c.Assert(checked[nodes[2]], check.Equals, 3)
+	mux.Unlock()
+	hb.Lock()
+	c.Assert(hb.health[nodes[2]], check.IsNil)
+	c.Assert(hb.health[nodes[1]], check.NotNil) // the ejected is kept until expired
+	hb.Unlock()
+}
+
+// runConcurrently call Next by the goroutines concurrently, and report
+// the feedback if it's a FeedbackBalancer, return the counts of each item.
+// there are at most 32 in-flight requests, a random one is done on each Next.
+func runConcurrently(b Balancer, items []Item, goroutines, n int) map[Item]int {
+	var (
+		cnt      = make(map[Item]int)
+		inflight = make([]Item, 0, 32)
+		mux      sync.Mutex // protect cnt & inflight
+		wg       sync.WaitGroup
+	)
+
+	fb, feedback := b.(FeedbackBalancer)
+
+	wg.Add(goroutines)
+	for i := 0; i < goroutines; i++ {
+		go func() {
+			defer wg.Done()
+
+			for j := 0; j < n; j++ {
+				next := b.Next(items)
+
+				var done Item
+				mux.Lock()
+				cnt[next]++
+				if feedback && next != nil {
+					if inflight = append(inflight, next); len(inflight) == cap(inflight) {
+						idx := rand.Intn(len(inflight))
+						done = inflight[idx]
+						inflight = append(inflight[:idx], inflight[idx+1:]...)
+					}
+				}
+				mux.Unlock()
+
+				if done != nil {
+					fb.Done(done, time.Millisecond, nil)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	return cnt
+}
+
+func (s *balancerSuit) TestRRConcurrently(c *check.C) {
+	nodes := newNodes(1, 1, 1, 1)
+	cnt := runConcurrently(NewRR(), nodes, 8, 1000)
+	for _, n := range nodes {
+		c.Assert(cnt[n], check.Equals, 2000)
+	}
+}
+
+func (s *balancerSuit) TestWeightDistribution(c *check.C) {
+	// negative weight treated as positive, 0 means disabled
+	nodes := newNodes(-1, 2, 3, 0)
+	cnt := runConcurrently(NewWeight(), nodes, 8, 7500)
+	c.Assert(cnt[nil], check.Equals, 0)
+	c.Assert(cnt[nodes[3]], check.Equals, 0)
+	for _, n := range nodes[:3] {
+		expect := float64(60000*absWeight(n)) / 6
+		c.Assert(math.Abs(float64(cnt[n])-expect) < expect*0.05, check.Equals, true, check.Commentf("%s: %d", n, cnt[n]))
+	}
+
+	c.Assert(NewWeight().Next(newNodes(0, 0)), check.IsNil)
+}
+
+func (s *balancerSuit) TestSmoothWeightConcurrently(c *check.C) {
+	// the smooth weighted round robin is exact on each round
+	nodes := newNodes(-1, 2, 3, 0)
+	cnt := runConcurrently(NewSmoothWeight(), nodes, 8, 600)
+	c.Assert(cnt[nodes[0]], check.Equals, 800)
+	c.Assert(cnt[nodes[1]], check.Equals, 1600)
+	c.Assert(cnt[nodes[2]], check.Equals, 2400)
+	c.Assert(cnt[nodes[3]], check.Equals, 0)
+}
+
+func (s *balancerSuit) TestFeedbackDistribution(c *check.C) {
+	newBalancers := map[string]func() Balancer{
+		"least conn":      func() Balancer { return NewLeastConn() },
+		"p2c":             func() Balancer { return NewP2C() },
+		"peak ewma":       func() Balancer { return NewPeakEWMA() },
+		"consistent hash": func() Balancer { return NewConsistentHash(1.25) },
+		"health":          func() Balancer { return NewHealth(NewSmoothWeight(), nil) },
+	}
+
+	for name, newBalancer := range newBalancers {
+		// even spread of the same weights, ±15%
+		nodes := newNodes(1, 1, 1, 1)
+		cnt := runConcurrently(newBalancer(), nodes, 8, 1000)
+		c.Assert(cnt[nil], check.Equals, 0, check.Commentf(name))
+		for _, n := range nodes {
+			c.Assert(cnt[n] > 1700 && cnt[n] < 2300, check.Equals, true, check.Commentf("%s %s: %d", name, n, cnt[n]))
+		}
+
+		// the heavier item gets more
+		nodes = newNodes(1, 3)
+		cnt = runConcurrently(newBalancer(), nodes, 8, 1000)
+		c.Assert(cnt[nodes[1]] > cnt[nodes[0]]*3/2, check.Equals, true, check.Commentf("%s: %d %d", name, cnt[nodes[0]], cnt[nodes[1]]))
+	}
+}
+
+func (s *balancerSuit) TestHealthPassiveSweep(c *check.C) {
+	var (
+		hb    = newHealthBalancer(NewRR(), &HealthOptions{Interval: time.Hour, MaxFails: 2})
+		nodes = newNodes(1, 1, 1, 1)
+		fail  = errors.New("connection refused")
+	)
+	defer hb.Close()
+
+	// the successes never create the health
+	for i := 0; i < 100; i++ {
+		hb.Done(&node{fmt.Sprint(i), 1}, 0, nil)
+	}
+	c.Assert(hb.health, check.HasLen, 0)
+
+	// the failing items are tracked until succeed
+	hb.Done(nodes[0], 0, fail)
+	hb.Done(nodes[1], 0, fail)
+	hb.Done(nodes[2], 0, fail)
+	hb.Done(nodes[2], 0, fail)
+	c.Assert(hb.Healthy(nodes[2]), check.Equals, false)
+	c.Assert(hb.health, check.HasLen, 3)
+	hb.Done(nodes[0], 0, nil)
+	c.Assert(hb.health, check.HasLen, 2)
+
+	// the items idle since the latest failure or ejection are swept once an interval
+	hb.Lock()
+	hb.health[nodes[1]].stamp = time.Now().Add(-time.Hour * 4)
+	hb.health[nodes[2]].stamp = time.Now().Add(-time.Hour * 4)
+	hb.Unlock()
+	hb.Done(nodes[3], 0, nil)
+	c.Assert(hb.health, check.HasLen, 2)
+
+	hb.Lock()
+	hb.sweptAt = time.Time{}
+	hb.Unlock()
+	hb.Done(nodes[3], 0, nil)
+	c.Assert(hb.health, check.HasLen, 1)
+	c.Assert(hb.Healthy(nodes[2]), check.Equals, false)
+
+	hb.Lock()
+	hb.sweptAt = time.Time{}
+	hb.health[nodes[2]].ejectTill = time.Now().Add(-time.Hour * 3)
+	hb.Unlock()
+	hb.Done(nodes[3], 0, nil)
+	c.Assert(hb.health, check.HasLen, 0)
+}
+
+func (s *balancerSuit) TestProxy(c *check.C) {
+	var upstreams []*Upstream
+	for _, name := range []string{"a", "b"} {
+		name := name
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/api/fail" {
+				w.WriteHeader(http.StatusInternalServerError)
+			}
+			fmt.Fprintf(w, "%s %s %s", name, r.URL.Path, r.URL.RawQuery)
+		}))
+		defer srv.Close()
+
+		u, err := NewUpstream(srv.URL+"/api", 1)
+		c.Assert(err, check.IsNil)
+		upstreams = append(upstreams, u)
+	}
+
+	// a dead upstream
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	dead, err := NewUpstream("http://"+ln.Addr().String(), 1)
+	c.Assert(err, check.IsNil)
+	ln.Close()
+	upstreams = append(upstreams, dead)
+
+	proxy := NewProxy(NewRR(), upstreams, nil)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	get := func(srv *httptest.Server, method, path string) (int, string) {
+		req, err := http.NewRequest(method, srv.URL+path, nil)
+		c.Assert(err, check.IsNil)
+		if method == "POST" {
+			req.Body = ioutil.NopCloser(strings.NewReader("data")) // with body
+		}
+		resp, err := http.DefaultClient.Do(req)
+		c.Assert(err, check.IsNil)
+		defer resp.Body.Close()
+		bs, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, check.IsNil)
+		return resp.StatusCode, string(bs)
+	}
+
+	// the upstream path is the prefix, the GET requests are retried on the dead upstream
+	for _, expect := range []string{"a /api/x q=1", "b /api/x q=1", "a /api/x q=1", "b /api/x q=1"} {
+		code, body := get(srv, "GET", "/x?q=1")
+		c.Assert(code, check.Equals, http.StatusOK)
+		c.Assert(body, check.Equals, expect)
+	}
+	c.Assert(dead.Stats(), check.DeepEquals, UpstreamStats{URL: dead.URL.String(), Requests: 1, Failures: 1, Retries: 1})
+
+	// the POST requests are not retried
+	code, _ := get(srv, "POST", "/x")
+	c.Assert(code, check.Equals, http.StatusBadGateway)
+
+	// the 5xx responses are counted as failures, but not retried
+	code, body := get(srv, "GET", "/fail")
+	c.Assert(code, check.Equals, http.StatusInternalServerError)
+	c.Assert(body, check.Equals, "a /api/fail ")
+
+	stats := proxy.Stats()
+	c.Assert(stats, check.HasLen, 3)
+	c.Assert(stats[0].Requests, check.Equals, int64(3))
+	c.Assert(stats[0].Failures, check.Equals, int64(1))
+	c.Assert(stats[1].Requests, check.Equals, int64(2))
+	c.Assert(stats[1].Failures, check.Equals, int64(0))
+	c.Assert(stats[2].Requests, check.Equals, int64(2))
+	c.Assert(stats[2].Failures, check.Equals, int64(2))
+	c.Assert(stats[2].Retries, check.Equals, int64(1))
+
+	// the dead upstream is ejected by the health balancer
+	proxy = NewProxy(NewHealth(NewRR(), &HealthOptions{MaxFails: 1}), upstreams, nil)
+	srv = httptest.NewServer(proxy)
+	defer srv.Close()
+	for i := 0; i < 6; i++ {
+		code, _ := get(srv, "GET", "/x")
+		c.Assert(code, check.Equals, http.StatusOK)
+	}
+	c.Assert(dead.Stats().Requests, check.Equals, int64(3))
+
+	// no available upstream once the only one ejected
+	proxy = NewProxy(NewHealth(NewRR(), &HealthOptions{MaxFails: 1}), []*Upstream{dead}, nil)
+	srv = httptest.NewServer(proxy)
+	defer srv.Close()
+	code, _ = get(srv, "GET", "/x")
+	c.Assert(code, check.Equals, http.StatusBadGateway)
+	code, _ = get(srv, "GET", "/x")
+	c.Assert(code, check.Equals, http.StatusServiceUnavailable)
+}
+
+func (s *balancerSuit) TestProxySlowBody(c *check.C) {
+	var (
+		upstreams []*Upstream
+		names     = make(map[*Upstream]string)
+		release   = make(chan struct{})
+	)
+	for _, name := range []string{"a", "b"} {
+		name := name
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			switch r.URL.Path {
+			case "/slow": // streaming until released
+				fmt.Fprint(w, name)
+				w.(http.Flusher).Flush()
+				<-release
+				fmt.Fprint(w, " done")
+			case "/broken": // the body is shorter than the Content-Length
+				w.Header().Set("Content-Length", "100")
+				fmt.Fprint(w, name)
+				w.(http.Flusher).Flush()
+				conn, _, _ := w.(http.Hijacker).Hijack()
+				conn.Close()
+			default:
+				fmt.Fprint(w, name)
+			}
+		}))
+		defer srv.Close()
+
+		u, err := NewUpstream(srv.URL, 1)
+		c.Assert(err, check.IsNil)
+		upstreams = append(upstreams, u)
+		names[u] = name
+	}
+
+	proxy := NewProxy(NewLeastConn(), upstreams, nil)
+	srv := httptest.NewServer(proxy)
+	defer srv.Close()
+
+	get := func(path string) (string, error) {
+		resp, err := http.Get(srv.URL + path)
+		if err != nil {
+			return "", err
+		}
+		defer resp.Body.Close()
+		bs, err := ioutil.ReadAll(resp.Body)
+		return string(bs), err
+	}
+	// wait the proxy finished the body after the client got it
+	wait := func(cond func() bool) {
+		for i := 0; i < 100 && !cond(); i++ {
+			time.Sleep(time.Millisecond * 10)
+		}
+		c.Assert(cond(), check.Equals, true)
+	}
+
+	// the upstream is busy until the body is streamed
+	resp, err := http.Get(srv.URL + "/slow")
+	c.Assert(err, check.IsNil)
+	buf := make([]byte, 1)
+	_, err = resp.Body.Read(buf)
+	c.Assert(err, check.IsNil)
+	var busy, idle *Upstream
+	for _, u := range upstreams {
+		if names[u] == string(buf) {
+			busy = u
+		} else {
+			idle = u
+		}
+	}
+	c.Assert(busy.Stats().InFlight, check.Equals, int64(1))
+
+	// the least connections routes the others away from the busy one
+	for i := 0; i < 4; i++ {
+		body, err := get("/fast")
+		c.Assert(err, check.IsNil)
+		c.Assert(body, check.Equals, names[idle])
+	}
+	c.Assert(busy.Stats().Requests, check.Equals, int64(1))
+	c.Assert(busy.Stats().InFlight, check.Equals, int64(1))
+
+	close(release)
+	rest, err := ioutil.ReadAll(resp.Body)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(rest), check.Equals, names[busy][1:]+" done")
+	resp.Body.Close()
+	wait(func() bool { return busy.Stats().InFlight == 0 })
+	c.Assert(busy.Stats().Failures, check.Equals, int64(0))
+
+	// the read error of the body is a failure
+	// note: the client may retry the GET once the connection aborted by the proxy
+	_, err = get("/broken")
+	c.Assert(err, check.NotNil)
+	var requests, failures int64
+	wait(func() bool {
+		requests, failures = 0, 0
+		for _, u := range upstreams {
+			st := u.Stats()
+			if st.InFlight != 0 {
+				return false
+			}
+			requests, failures = requests+st.Requests, failures+st.Failures
+		}
+		return true
+	})
+	c.Assert(requests > 5, check.Equals, true)
+	c.Assert(failures, check.Equals, requests-5)
+}
+
+func (s *balancerSuit) TestProxyConsistentHash(c *check.C) {
+	var (
+		upstreams []*Upstream
+		names     = make(map[Item]string)
+	)
+	for _, name := range []string{"a", "b", "c"} {
+		name := name
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			fmt.Fprint(w, name)
+		}))
+		defer srv.Close()
+
+		u, err := NewUpstream(srv.URL, 1)
+		c.Assert(err, check.IsNil)
+		upstreams = append(upstreams, u)
+		names[u] = name
+	}
+
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+	dead, err := NewUpstream("http://"+ln.Addr().String(), 1)
+	c.Assert(err, check.IsNil)
+	ln.Close()
+	upstreams = append(upstreams, dead)
+
+	var (
+		chash = NewConsistentHash(0)
+		hb    = NewHealth(chash, &HealthOptions{MaxFails: 1})
+		proxy = NewProxy(hb, upstreams, &ProxyOptions{HashKey: func(r *http.Request) string { return r.URL.Query().Get("key") }})
+		srv   = httptest.NewServer(proxy)
+	)
+	defer srv.Close()
+	defer hb.Close()
+
+	get := func(key string) string {
+		resp, err := http.Get(srv.URL + "/?key=" + key)
+		c.Assert(err, check.IsNil)
+		defer resp.Body.Close()
+		c.Assert(resp.StatusCode, check.Equals, http.StatusOK)
+		bs, err := ioutil.ReadAll(resp.Body)
+		c.Assert(err, check.IsNil)
+		return string(bs)
+	}
+
+	// the expected owners on the ring with & without the dead upstream
+	var (
+		all   = make([]Item, 0, len(upstreams))
+		alive = make([]Item, 0, len(upstreams))
+	)
+	for _, u := range upstreams {
+		all = append(all, u)
+		if u != dead {
+			alive = append(alive, u)
+		}
+	}
+	owner, successor := NewConsistentHash(0), NewConsistentHash(0)
+
+	var ring *ketamaNode
+	for i := 0; i < 50; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		expect := names[successor.NextKey(key, alive)]
+		if owned := owner.NextKey(key, all); owned != dead {
+			c.Assert(names[owned], check.Equals, expect)
+		}
+
+		// the retries & the ejection of the dead upstream keep the key affinity
+		for j := 0; j < 3; j++ {
+			c.Assert(get(key), check.Equals, expect, check.Commentf("%s #%d", key, j))
+		}
+
+		// the ring is never rebuilt by the subsets of the upstreams
+		cb := chash.(*chashBalancer)
+		cb.Lock()
+		if ring == nil {
+			ring = &cb.ring[0]
+		}
+		c.Assert(&cb.ring[0], check.Equals, ring)
+		cb.Unlock()
+	}
+	c.Assert(dead.Stats().Requests, check.Equals, int64(1))
+	c.Assert(hb.Healthy(dead), check.Equals, false)
+}
@@ -0,0 +1,256 @@
+package balancer
+
+import (
+	"crypto/md5"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"math/rand"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+)
+
+var (
+	// nb of md5 digests per item on the ring on average, each item takes
+	// the share of its weight, each digest gives 4 virtual nodes as ketama does
+	ketamaReplicas = 40
+
+	// the items not given by the latest nb of calls are removed from the ring
+	ketamaPruneCalls uint64 = 1024
+)
+
+// chashBalancer is the consistent hashing balancer on a ketama ring, the items
+// own 160 virtual nodes on average in proportion to their weights, so the ring
+// size is independent of the weights' scale. only the keys of the removed items
+// are moved, and the added items take over keys evenly from the others (a few
+// keys are moved between the others as well if the weights differ, as the weight
+// shares changed).
+//
+// with bounded loads, each item accepts at most ceil(loadFactor * (in-flight + 1) * weight / total weight)
+// in-flight requests, the overflowed keys go to the next items on the ring, see
+// https://arxiv.org/abs/1608.01350
+//
+// the ring is only rebuilt on the new items or the weight changes, the items not
+// given by the call are skipped by walking the ring, eg: the tried or unhealthy
+// items, so a subset of the items never rebuilds the ring, and the in-flight loads
+// are tracked independent of the ring.
+//
+// note: the item's key on the ring is its Key() if it implements KeyItem, or its
+// String() if it implements fmt.Stringer, or itself if it's a string type, it must
+// be unique and stable across processes, the items without such a key are skipped.
+type chashBalancer struct {
+	sync.Mutex                        // protect followings
+	loadFactor float64                // bounded load factor, 0 means unbounded
+	members    map[Item]*ketamaMember // the items on the ring
+	ring       []ketamaNode           // virtual nodes sorted by hash
+	calls      uint64                 // nb of calls, the sequence of current call
+	prunedAt   uint64                 // the call of the latest pruning check
+	loads      map[Item]int           // nb of in-flight requests of each item
+	inflight   int                    // nb of in-flight requests of all items
+}
+
+type ketamaMember struct {
+	key    string // the item's key on the ring, empty if the item has no key
+	weight int    // abs weight of the item when added on the ring
+	seen   uint64 // the latest call given the item
+}
+
+type ketamaNode struct {
+	hash   uint32
+	item   Item
+	member *ketamaMember
+}
+
+// NextKey implement the HashBalancer interface
+func (b *chashBalancer) NextKey(key string, items []Item) Item {
+	b.Lock()
+	defer b.Unlock()
+
+	wsum := b.update(items)
+	if wsum == 0 {
+		return nil
+	}
+
+	hash := ketamaHash(key)
+	idx := sort.Search(len(b.ring), func(i int) bool { return b.ring[i].hash >= hash })
+
+	item := b.walk(idx, wsum)
+	if item == nil {
+		return nil
+	}
+
+	b.loads[item]++
+	b.inflight++
+	return item
+}
+
+// walk the ring clockwise from idx, until found an item given by current call,
+// and under its capacity with bounded loads
+func (b *chashBalancer) walk(idx, wsum int) Item {
+	var first Item
+	for i := 0; i < len(b.ring); i++ {
+		node := b.ring[(idx+i)%len(b.ring)]
+		if node.member.seen != b.calls {
+			continue
+		}
+		if b.loadFactor == 0 {
+			return node.item
+		}
+		if first == nil {
+			first = node.item
+		}
+		capacity := math.Ceil(b.loadFactor * float64(b.inflight+1) * float64(node.member.weight) / float64(wsum))
+		if float64(b.loads[node.item]) < capacity {
+			return node.item
+		}
+	}
+	// never reached with bounded loads, as the sum of capacity is greater than the in-flight requests
+	return first
+}
+
+// Next implement the Balancer interface, select by a random key
+func (b *chashBalancer) Next(items []Item) Item {
+	return b.NextKey(strconv.Itoa(rand.Int()), items)
+}
+
+// Done implement the FeedbackBalancer interface, only
+// the in-flight requests are tracked for the bounded loads
+func (b *chashBalancer) Done(item Item, latency time.Duration, err error) {
+	b.Lock()
+	defer b.Unlock()
+
+	if n := b.loads[item]; n > 0 {
+		if n == 1 {
+			delete(b.loads, item)
+		} else {
+			b.loads[item]--
+		}
+		b.inflight--
+	}
+}
+
+// update mark the items as seen by current call, and rebuild the ring if any
+// of the items is new or its weight changed, or some items should be pruned.
+// it returns the weight sum of the items.
+func (b *chashBalancer) update(items []Item) int {
+	b.calls++
+
+	var (
+		wsum    int
+		rebuild bool
+	)
+	for _, item := range items {
+		w := absWeight(item)
+		m, ok := b.members[item]
+		if !ok || m.weight != w {
+			rebuild = true
+		} else if m.seen != b.calls {
+			m.seen = b.calls
+			if m.key != "" {
+				wsum += w
+			}
+		}
+	}
+
+	if !rebuild && b.calls-b.prunedAt >= ketamaPruneCalls {
+		b.prunedAt = b.calls
+		for _, m := range b.members {
+			if b.calls-m.seen >= ketamaPruneCalls {
+				rebuild = true
+				break
+			}
+		}
+	}
+
+	if rebuild {
+		wsum = b.rebuild(items)
+	}
+	return wsum
+}
+
+// rebuild the ring by the items and the members seen recently, it returns
+// the weight sum of the items.
+func (b *chashBalancer) rebuild(items []Item) int {
+	members := make(map[Item]*ketamaMember, len(items))
+	for item, m := range b.members {
+		if b.calls-m.seen < ketamaPruneCalls {
+			members[item] = m
+		}
+	}
+
+	for _, item := range items {
+		w := absWeight(item)
+		if m, ok := members[item]; !ok || m.weight != w {
+			members[item] = &ketamaMember{key: itemKey(item), weight: w}
+		}
+		members[item].seen = b.calls
+	}
+
+	var wsum, total, enabled int
+	for _, m := range members {
+		if m.key == "" {
+			continue // never on the ring
+		}
+		if m.seen == b.calls {
+			wsum += m.weight
+		}
+		if m.weight > 0 {
+			total += m.weight
+			enabled++
+		}
+	}
+
+	b.members = members
+	b.prunedAt = b.calls
+	b.ring = make([]ketamaNode, 0, (ketamaReplicas+1)*enabled*4)
+	for item, m := range members {
+		if m.key == "" || m.weight == 0 {
+			continue // the disabled items have no nodes
+		}
+		// the share of the weight, as ketama does, at least one replica so
+		// the item with a tiny share is still selectable, eg: among a subset
+		replicas := int(math.Floor(float64(ketamaReplicas*enabled) * float64(m.weight) / float64(total)))
+		if replicas < 1 {
+			replicas = 1
+		}
+		for i := 0; i < replicas; i++ {
+			digest := md5.Sum([]byte(m.key + "-" + strconv.Itoa(i)))
+			for j := 0; j < 4; j++ {
+				b.ring = append(b.ring, ketamaNode{binary.LittleEndian.Uint32(digest[j*4:]), item, m})
+			}
+		}
+	}
+	// note: the members are in random order, the items' keys break the ties
+	sort.Slice(b.ring, func(i, j int) bool {
+		if b.ring[i].hash != b.ring[j].hash {
+			return b.ring[i].hash < b.ring[j].hash
+		}
+		return b.ring[i].member.key < b.ring[j].member.key
+	})
+
+	return wsum
+}
+
+func ketamaHash(key string) uint32 {
+	digest := md5.Sum([]byte(key))
+	return binary.LittleEndian.Uint32(digest[:4])
+}
+
+// itemKey return the item's stable key on the ring, it's empty if the item is
+// none of KeyItem, fmt.Stringer and string type, as fmt.Sprint of a pointer is
+// the address, which differs between processes and breaks the consistent hashing.
+func itemKey(item Item) string {
+	switch v := item.(type) {
+	case KeyItem:
+		return v.Key()
+	case fmt.Stringer:
+		return v.String()
+	}
+	if v := reflect.ValueOf(item); v.Kind() == reflect.String {
+		return v.String()
+	}
+	return ""
+}
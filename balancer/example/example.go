@@ -2,6 +2,7 @@ package main
 
 import (
 	"fmt"
+	"time"
 
 	"../../balancer"
 )
@@ -15,6 +16,11 @@ func (n *node) WeightN() int {
 	return n.weight
 }
 
+// String is the node's key on the consistent hash ring
+func (n *node) String() string {
+	return n.id
+}
+
 func main() {
 	nodes := []balancer.Item{
 		&node{"node1", 1},
@@ -51,4 +57,40 @@ func main() {
 	for node, count := range cnt {
 		fmt.Println(node.id, node.weight, count)
 	}
+
+	fmt.Println("--------> Smooth Weight Balancer")
+	swr := balancer.NewSmoothWeight()
+	for i := 1; i <= 15; i++ {
+		next := swr.Next(nodes) // items could be added / removed between calls
+		if next == nil {
+			continue
+		}
+		fmt.Println(i, next.(*node).id)
+	}
+
+	fmt.Println("--------> Peak EWMA Balancer")
+	ewma := balancer.NewPeakEWMA()
+	cnt = make(map[*node]int)
+	for i := 1; i <= 1000; i++ {
+		next := ewma.Next(nodes)
+		if next == nil {
+			continue
+		}
+		cnt[next.(*node)]++
+		// report the feedback, the heavier node is slower in this example
+		ewma.Done(next, time.Millisecond*time.Duration(next.WeightN()), nil)
+	}
+	for node, count := range cnt {
+		fmt.Println(node.id, node.weight, count)
+	}
+
+	fmt.Println("--------> Consistent Hash Balancer")
+	ch := balancer.NewConsistentHash(0)
+	for _, key := range []string{"user1", "user2", "user3", "user1"} {
+		next := ch.NextKey(key, nodes) // the same key always goes to the same node
+		if next == nil {
+			continue
+		}
+		fmt.Println(key, next.(*node).id)
+	}
 }
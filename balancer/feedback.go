@@ -0,0 +1,219 @@
+package balancer
+
+import (
+	"math"
+	"math/rand"
+	"sync"
+	"time"
+)
+
+var (
+	// the decay time of the latency EWMA, the older samples' weight
+	// decays to 1/e after each decay time
+	ewmaDecay = time.Second * 10
+
+	// the failed requests are treated as taking at least the penalty latency,
+	// so a fast failing item won't look like a fast one
+	failPenalty = time.Second
+)
+
+// tracker tracks the in-flight requests & latency EWMA of each item by the
+// feedback of Done, it's the base of the feedback balancers.
+//
+// note: the items are used as map keys, so they must be comparable, eg: pointers.
+type tracker struct {
+	sync.Mutex                     // protect followings
+	stats      map[Item]*itemStats // stats of each item
+	gen        uint64              // generation of Next calls, to sweep the removed items
+	offset     int                 // rotating start offset to break the ties
+}
+
+type itemStats struct {
+	weight   int       // abs weight of the latest Next
+	inflight int       // nb of in-flight requests
+	ewma     float64   // peak EWMA of latency, nanoseconds, 0 means not measured yet
+	stamp    time.Time // the time of the latest sample
+	gen      uint64    // the generation of last seen
+}
+
+// load return the in-flight requests (include the new one) relative to the weight
+func (s *itemStats) load() float64 {
+	return float64(s.inflight+1) / float64(s.weight)
+}
+
+// observe take a latency sample into the EWMA, the EWMA jumps to the
+// sample immediately if it's higher (the peak), and decays to lower ones
+// by the time elapsed since the latest sample.
+func (s *itemStats) observe(latency time.Duration, err error) {
+	sample := float64(latency)
+	if err != nil && sample < float64(failPenalty) {
+		sample = float64(failPenalty)
+	}
+
+	now := time.Now()
+	if s.ewma == 0 || sample > s.ewma {
+		s.ewma = sample
+	} else {
+		w := math.Exp(-float64(now.Sub(s.stamp)) / float64(ewmaDecay))
+		s.ewma = s.ewma*w + sample*(1-w)
+	}
+	s.stamp = now
+}
+
+func newTracker() tracker {
+	return tracker{
+		stats: make(map[Item]*itemStats),
+	}
+}
+
+// candidates return the enabled items with their stats, must be called under lock
+func (t *tracker) candidates(items []Item) ([]Item, []*itemStats) {
+	t.gen++
+
+	var (
+		cands = make([]Item, 0, len(items))
+		stats = make([]*itemStats, 0, len(items))
+	)
+	for _, item := range items {
+		w := absWeight(item)
+		if w == 0 { // disabled
+			continue
+		}
+
+		st, ok := t.stats[item]
+		if !ok {
+			st = new(itemStats)
+			t.stats[item] = st
+		}
+		st.weight, st.gen = w, t.gen
+
+		cands = append(cands, item)
+		stats = append(stats, st)
+	}
+
+	// sweep the removed items, unless they still have in-flight requests
+	if len(t.stats) > len(items) {
+		for item, st := range t.stats {
+			if st.gen != t.gen && st.inflight == 0 {
+				delete(t.stats, item)
+			}
+		}
+	}
+
+	return cands, stats
+}
+
+// pickMin pick the item with the minimum cost, the ties are broken by
+// rotating the start offset, must be called under lock
+func (t *tracker) pickMin(cands []Item, stats []*itemStats, cost func(*itemStats) float64) Item {
+	if len(cands) == 0 {
+		return nil
+	}
+
+	t.offset++
+	var (
+		best     = -1
+		bestCost float64
+	)
+	for i := range cands {
+		idx := (t.offset + i) % len(cands)
+		if c := cost(stats[idx]); best < 0 || c < bestCost {
+			best, bestCost = idx, c
+		}
+	}
+
+	stats[best].inflight++
+	return cands[best]
+}
+
+// Done implement the FeedbackBalancer interface
+func (t *tracker) Done(item Item, latency time.Duration, err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	st, ok := t.stats[item]
+	if !ok {
+		return
+	}
+	if st.inflight > 0 {
+		st.inflight--
+	}
+	st.observe(latency, err)
+}
+
+// lcBalancer selects the item with the least in-flight requests relative to its weight
+type lcBalancer struct {
+	tracker
+}
+
+func (b *lcBalancer) Next(items []Item) Item {
+	b.Lock()
+	defer b.Unlock()
+
+	cands, stats := b.candidates(items)
+	return b.pickMin(cands, stats, (*itemStats).load)
+}
+
+// p2cBalancer is the power of two choices balancer, it picks two random items
+// and selects the one with less in-flight requests relative to its weight, which
+// avoids the herd behavior of least connections with stale load information.
+type p2cBalancer struct {
+	tracker
+}
+
+func (b *p2cBalancer) Next(items []Item) Item {
+	b.Lock()
+	defer b.Unlock()
+
+	cands, stats := b.candidates(items)
+	if len(cands) <= 1 {
+		return b.pickMin(cands, stats, (*itemStats).load)
+	}
+
+	i := rand.Intn(len(cands))
+	j := rand.Intn(len(cands) - 1)
+	if j >= i {
+		j++
+	}
+	if stats[j].load() < stats[i].load() {
+		i = j
+	}
+
+	stats[i].inflight++
+	return cands[i]
+}
+
+// ewmaBalancer is the peak EWMA balancer, it selects the item with the least
+// cost: latency EWMA * (in-flight requests + 1) / weight, so the slow items
+// are routed away quickly once their latency rises.
+//
+// note: the not measured item is treated as the fastest measured one, so it
+// gets measured soon, and won't be flooded as its in-flight requests counted.
+type ewmaBalancer struct {
+	tracker
+}
+
+func (b *ewmaBalancer) Next(items []Item) Item {
+	b.Lock()
+	defer b.Unlock()
+
+	cands, stats := b.candidates(items)
+
+	var fastest float64
+	for _, st := range stats {
+		if st.ewma > 0 && (fastest == 0 || st.ewma < fastest) {
+			fastest = st.ewma
+		}
+	}
+	if fastest == 0 {
+		fastest = 1
+	}
+
+	return b.pickMin(cands, stats, func(st *itemStats) float64 {
+		ewma := st.ewma
+		if ewma == 0 {
+			ewma = fastest
+		}
+		return ewma * st.load()
+	})
+}
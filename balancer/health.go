@@ -0,0 +1,341 @@
+package balancer
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+var (
+	// the items not given for the nb of intervals before the latest Next call
+	// are neither checked actively nor tracked any more, and without the active
+	// checks, the items not reported by Done for the nb of intervals are swept
+	healthSeenIntervals = 3
+)
+
+// HealthOptions is the optional settings of the health checking
+type HealthOptions struct {
+	// Check is the active health check of an item, nil disables the active checks,
+	// the item is marked as down once the check failed, and up once succeed.
+	// see TCPCheck, HTTPCheck
+	Check func(ctx context.Context, item Item) error
+	// Interval is the interval of the active checks, or of sweeping the idle
+	// items without the active checks, default 10s
+	Interval time.Duration
+	// Timeout is the timeout of each active check, default 2s
+	Timeout time.Duration
+
+	// MaxFails is the nb of consecutive failures reported by Done to eject
+	// the item (passive outlier detection), default 3, -1 disables the ejection.
+	MaxFails int
+	// Backoff is the ejection period, doubled on each consecutive ejection
+	// up to MaxBackoff, default 10s & 5m
+	Backoff    time.Duration
+	MaxBackoff time.Duration
+}
+
+// healthBalancer filters out the unhealthy items before the underlying
+// balancer selecting, so Next never returns an unhealthy item.
+//
+// note: the items are used as map keys, so they must be comparable, eg: pointers.
+// the active checks run against all of the items given by the Next calls
+// recently, as the calls may be subsets, eg: the retries exclude the tried items.
+type healthBalancer struct {
+	b    Balancer
+	opts HealthOptions
+
+	sync.Mutex                      // protect followings
+	seen       map[Item]time.Time   // the latest time each item given by the Next calls
+	seenAt     time.Time            // the time of the latest Next call
+	health     map[Item]*itemHealth // health of each item
+	sweptAt    time.Time            // the latest sweeping without the active checks
+	stopCh     chan struct{}        // stop the active checks
+	closeOnce  sync.Once
+}
+
+type itemHealth struct {
+	down      bool      // failed the active check
+	fails     int       // nb of consecutive failures
+	ejections int       // nb of consecutive ejections
+	ejectTill time.Time // ejected until
+	stamp     time.Time // the latest failure reported by Done
+}
+
+func (h *itemHealth) healthy(now time.Time) bool {
+	return !h.down && !now.Before(h.ejectTill)
+}
+
+func newHealthBalancer(b Balancer, opts *HealthOptions) *healthBalancer {
+	o := HealthOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Interval <= 0 {
+		o.Interval = time.Second * 10
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = time.Second * 2
+	}
+	if o.MaxFails == 0 {
+		o.MaxFails = 3
+	}
+	if o.Backoff <= 0 {
+		o.Backoff = time.Second * 10
+	}
+	if o.MaxBackoff <= 0 {
+		o.MaxBackoff = time.Minute * 5
+	}
+
+	hb := &healthBalancer{
+		b:      b,
+		opts:   o,
+		seen:   make(map[Item]time.Time),
+		health: make(map[Item]*itemHealth),
+		stopCh: make(chan struct{}),
+	}
+	if o.Check != nil {
+		go hb.checkLoop()
+	}
+	return hb
+}
+
+// Next implement the Balancer interface
+func (hb *healthBalancer) Next(items []Item) Item {
+	healthy := hb.healthy(items)
+	if len(healthy) == 0 {
+		return nil
+	}
+	return hb.b.Next(healthy)
+}
+
+// NextKey implement the HashBalancer interface, the key is passed to the
+// underlying balancer if it's a HashBalancer, so the key affinity is kept
+// among the healthy items, otherwise it's selected by Next.
+func (hb *healthBalancer) NextKey(key string, items []Item) Item {
+	healthy := hb.healthy(items)
+	if len(healthy) == 0 {
+		return nil
+	}
+	if b, ok := hb.b.(HashBalancer); ok {
+		return b.NextKey(key, healthy)
+	}
+	return hb.b.Next(healthy)
+}
+
+// healthy record the items for the active checks, and return the healthy ones
+func (hb *healthBalancer) healthy(items []Item) []Item {
+	hb.Lock()
+	defer hb.Unlock()
+
+	var (
+		now     = time.Now()
+		healthy = make([]Item, 0, len(items))
+	)
+	if hb.opts.Check != nil {
+		hb.seenAt = now
+	}
+	for _, item := range items {
+		if hb.opts.Check != nil {
+			hb.seen[item] = now
+		}
+		if h, ok := hb.health[item]; ok && !h.healthy(now) {
+			continue
+		}
+		healthy = append(healthy, item)
+	}
+	return healthy
+}
+
+// Done implement the FeedbackBalancer interface, the item is ejected after
+// MaxFails consecutive failures, the feedback is passed to the underlying
+// balancer if it's a FeedbackBalancer.
+func (hb *healthBalancer) Done(item Item, latency time.Duration, err error) {
+	if fb, ok := hb.b.(FeedbackBalancer); ok {
+		fb.Done(item, latency, err)
+	}
+
+	if hb.opts.MaxFails < 0 {
+		return
+	}
+
+	hb.Lock()
+	defer hb.Unlock()
+
+	now := time.Now()
+	if hb.opts.Check == nil && now.Sub(hb.sweptAt) >= hb.opts.Interval {
+		hb.sweep(now)
+	}
+
+	// note: the success never creates the health, and the health same as the
+	// absent one is removed, so the map only holds the failing items
+	if err == nil {
+		if h, ok := hb.health[item]; ok {
+			h.fails, h.ejections = 0, 0
+			if !h.down && !now.Before(h.ejectTill) {
+				delete(hb.health, item)
+			}
+		}
+		return
+	}
+
+	h := hb.get(item)
+	h.stamp = now
+	h.fails++
+	if h.fails < hb.opts.MaxFails {
+		return
+	}
+
+	// eject with the doubled backoff
+	backoff := hb.opts.Backoff
+	for i := 0; i < h.ejections && backoff < hb.opts.MaxBackoff; i++ {
+		backoff *= 2
+	}
+	if backoff > hb.opts.MaxBackoff {
+		backoff = hb.opts.MaxBackoff
+	}
+	h.fails = 0
+	h.ejections++
+	h.ejectTill = now.Add(backoff)
+}
+
+// sweep remove the items not reported by Done for several intervals since the
+// latest failure or ejection, as the checkAll sweeping never runs without the
+// active checks, eg: the churning upstreams. must be called under lock.
+func (hb *healthBalancer) sweep(now time.Time) {
+	hb.sweptAt = now
+
+	idle := hb.opts.Interval * time.Duration(healthSeenIntervals)
+	for item, h := range hb.health {
+		last := h.stamp
+		if h.ejectTill.After(last) {
+			last = h.ejectTill
+		}
+		if now.Sub(last) >= idle {
+			delete(hb.health, item)
+		}
+	}
+}
+
+// Healthy implement the HealthBalancer interface
+func (hb *healthBalancer) Healthy(item Item) bool {
+	hb.Lock()
+	defer hb.Unlock()
+
+	h, ok := hb.health[item]
+	return !ok || h.healthy(time.Now())
+}
+
+// Close implement the HealthBalancer interface
+func (hb *healthBalancer) Close() {
+	hb.closeOnce.Do(func() { close(hb.stopCh) })
+}
+
+// get return the health of the item, must be called under lock
+func (hb *healthBalancer) get(item Item) *itemHealth {
+	h, ok := hb.health[item]
+	if !ok {
+		h = new(itemHealth)
+		hb.health[item] = h
+	}
+	return h
+}
+
+func (hb *healthBalancer) checkLoop() {
+	ticker := time.NewTicker(hb.opts.Interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-hb.stopCh:
+			return
+		case <-ticker.C:
+			hb.checkAll()
+		}
+	}
+}
+
+// checkAll run the active checks of all items given recently concurrently
+func (hb *healthBalancer) checkAll() {
+	hb.Lock()
+
+	// sweep the items not given for several intervals before the latest call,
+	// so the items are kept if idle, and the ejected items are kept until expired.
+	// note: each call may be a subset of the items, eg: the retries of the proxy
+	// exclude the tried items, so the items given by any call recently are kept
+	// with their consecutive failures.
+	var (
+		now    = time.Now()
+		expiry = hb.seenAt.Add(-hb.opts.Interval * time.Duration(healthSeenIntervals))
+		items  = make([]Item, 0, len(hb.seen))
+	)
+	for item, at := range hb.seen {
+		if at.Before(expiry) {
+			delete(hb.seen, item)
+			continue
+		}
+		items = append(items, item)
+	}
+	for item, h := range hb.health {
+		if _, ok := hb.seen[item]; !ok && !now.Before(h.ejectTill) {
+			delete(hb.health, item)
+		}
+	}
+	hb.Unlock()
+
+	var wg sync.WaitGroup
+	wg.Add(len(items))
+	for _, item := range items {
+		go func(item Item) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(context.Background(), hb.opts.Timeout)
+			err := hb.opts.Check(ctx, item)
+			cancel()
+
+			hb.Lock()
+			hb.get(item).down = err != nil
+			hb.Unlock()
+		}(item)
+	}
+	wg.Wait()
+}
+
+// TCPCheck return an active check which connects to the address of the item
+func TCPCheck(addr func(Item) string) func(context.Context, Item) error {
+	return func(ctx context.Context, item Item) error {
+		conn, err := new(net.Dialer).DialContext(ctx, "tcp", addr(item))
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	}
+}
+
+// HTTPCheck return an active check which requests the url of the item,
+// the 2xx & 3xx status codes are treated as healthy.
+func HTTPCheck(url func(Item) string) func(context.Context, Item) error {
+	client := &http.Client{
+		// don't follow the redirects
+		CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse },
+	}
+
+	return func(ctx context.Context, item Item) error {
+		req, err := http.NewRequest("GET", url(item), nil)
+		if err != nil {
+			return err
+		}
+		resp, err := client.Do(req.WithContext(ctx))
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+
+		if code := resp.StatusCode; code < 200 || code >= 400 {
+			return fmt.Errorf("%d - %s", code, http.StatusText(code))
+		}
+		return nil
+	}
+}
@@ -0,0 +1,332 @@
+package balancer
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httputil"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	// ErrNoUpstream is exported
+	ErrNoUpstream = errors.New("no available upstream")
+)
+
+// Upstream is an upstream of the reverse proxy, it's the Item to be selected
+type Upstream struct {
+	URL    *url.URL
+	Weight int
+
+	// counters, atomic
+	requests int64 // nb of requests sent, include the retries
+	failures int64 // nb of failed requests: connection errors & 5xx responses
+	retries  int64 // nb of requests retried on other upstreams after failed
+	inflight int64 // nb of in-flight requests
+}
+
+// UpstreamStats is the counters of an upstream
+type UpstreamStats struct {
+	URL      string `json:"url"`
+	Requests int64  `json:"requests"`
+	Failures int64  `json:"failures"`
+	Retries  int64  `json:"retries"`
+	InFlight int64  `json:"inflight"`
+}
+
+// NewUpstream is exported
+func NewUpstream(rawurl string, weight int) (*Upstream, error) {
+	u, err := url.Parse(rawurl)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" && u.Scheme != "https" {
+		return nil, fmt.Errorf("invalid upstream %q, only http & https supported", rawurl)
+	}
+	return &Upstream{URL: u, Weight: weight}, nil
+}
+
+// WeightN implement the Item interface
+func (u *Upstream) WeightN() int {
+	return u.Weight
+}
+
+// Key implement the KeyItem interface, the upstream's key on the consistent hash ring
+func (u *Upstream) Key() string {
+	return u.URL.String()
+}
+
+// Stats return the counters of the upstream
+func (u *Upstream) Stats() UpstreamStats {
+	return UpstreamStats{
+		URL:      u.URL.String(),
+		Requests: atomic.LoadInt64(&u.requests),
+		Failures: atomic.LoadInt64(&u.failures),
+		Retries:  atomic.LoadInt64(&u.retries),
+		InFlight: atomic.LoadInt64(&u.inflight),
+	}
+}
+
+// ProxyOptions is the optional settings of the reverse proxy
+type ProxyOptions struct {
+	// Transport is used to send the requests to the upstreams, default http.DefaultTransport
+	Transport http.RoundTripper
+	// MaxRetries is the max retries on other upstreams after connection errors,
+	// only the idempotent requests without body are retried, default 2, -1 disables the retries.
+	MaxRetries int
+	// HashKey is the key of the request for the HashBalancer, eg: the client ip,
+	// the request is selected by Next if not set.
+	HashKey func(*http.Request) string
+}
+
+// Proxy is the http reverse proxy selects an upstream for each request by the balancer,
+// the result of each request is reported to the balancer if it's a FeedbackBalancer, so
+// the HealthBalancer could eject the failing upstreams.
+type Proxy struct {
+	b         Balancer
+	upstreams []*Upstream
+	items     []Item
+	opts      ProxyOptions
+	rp        *httputil.ReverseProxy
+}
+
+// NewProxy is exported
+func NewProxy(b Balancer, upstreams []*Upstream, opts *ProxyOptions) *Proxy {
+	o := ProxyOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Transport == nil {
+		o.Transport = http.DefaultTransport
+	}
+	if o.MaxRetries == 0 {
+		o.MaxRetries = 2
+	}
+	if o.MaxRetries < 0 {
+		o.MaxRetries = 0
+	}
+
+	items := make([]Item, 0, len(upstreams))
+	for _, u := range upstreams {
+		items = append(items, u)
+	}
+
+	p := &Proxy{
+		b:         b,
+		upstreams: upstreams,
+		items:     items,
+		opts:      o,
+	}
+	p.rp = &httputil.ReverseProxy{
+		Director:     func(*http.Request) {}, // note: the url is rewritten on each attempt by RoundTrip
+		Transport:    p,
+		ErrorHandler: p.errorHandler,
+	}
+	return p
+}
+
+// ServeHTTP implement the http.Handler interface
+func (p *Proxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	p.rp.ServeHTTP(w, r)
+}
+
+// Stats return the counters of each upstream
+func (p *Proxy) Stats() []UpstreamStats {
+	stats := make([]UpstreamStats, 0, len(p.upstreams))
+	for _, u := range p.upstreams {
+		stats = append(stats, u.Stats())
+	}
+	return stats
+}
+
+// RoundTrip implement the http.RoundTripper interface, select an upstream for
+// each attempt, the idempotent requests without body are retried on the other
+// upstreams after connection errors.
+func (p *Proxy) RoundTrip(req *http.Request) (*http.Response, error) {
+	var (
+		tried = make(map[Item]bool)
+		err   error
+	)
+
+	for i := 0; i <= p.opts.MaxRetries; i++ {
+		u := p.next(req, tried)
+		if u == nil {
+			if err == nil {
+				err = ErrNoUpstream
+			}
+			return nil, err
+		}
+		tried[u] = true
+
+		var resp *http.Response
+		if resp, err = p.roundTrip(u, req); err == nil {
+			return resp, nil
+		}
+
+		if !retriable(req) || req.Context().Err() != nil {
+			return nil, err
+		}
+		atomic.AddInt64(&u.retries, 1)
+	}
+
+	return nil, err
+}
+
+// roundTrip send the request to the upstream, and report the result to the
+// balancer once the response body is streamed, so the long responses (eg:
+// downloads, SSE) are counted as the in-flight load until finished.
+func (p *Proxy) roundTrip(u *Upstream, req *http.Request) (*http.Response, error) {
+	outreq := new(http.Request)
+	*outreq = *req
+	outreq.URL = rewriteURL(u.URL, req.URL)
+
+	atomic.AddInt64(&u.requests, 1)
+	atomic.AddInt64(&u.inflight, 1)
+
+	startAt := time.Now()
+	done := func(failure error) {
+		atomic.AddInt64(&u.inflight, -1)
+		if fb, ok := p.b.(FeedbackBalancer); ok {
+			fb.Done(u, time.Since(startAt), failure)
+		}
+	}
+
+	resp, err := p.opts.Transport.RoundTrip(outreq)
+	if err != nil {
+		atomic.AddInt64(&u.failures, 1)
+		done(err)
+		return nil, err
+	}
+
+	// the 5xx responses are reported as failures, but not retried
+	var failure error
+	if resp.StatusCode >= 500 {
+		failure = fmt.Errorf("%d - %s", resp.StatusCode, http.StatusText(resp.StatusCode))
+		atomic.AddInt64(&u.failures, 1)
+	}
+	resp.Body = &upstreamBody{ReadCloser: resp.Body, ctx: req.Context(), failure: failure, done: func(err error) {
+		if failure == nil && err != nil {
+			atomic.AddInt64(&u.failures, 1)
+		}
+		done(err)
+	}}
+	return resp, nil
+}
+
+// upstreamBody report the result of the request once the body is read to the
+// end or closed, the read errors are reported as failures, except the ones
+// caused by the client canceled.
+type upstreamBody struct {
+	io.ReadCloser
+	ctx     context.Context
+	failure error // the failure of the response, eg: 5xx
+	done    func(failure error)
+	once    sync.Once
+}
+
+// Read implement the io.Reader interface
+func (b *upstreamBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if err == io.EOF {
+		b.finish(nil)
+	} else if err != nil {
+		b.finish(err)
+	}
+	return n, err
+}
+
+// Close implement the io.Closer interface
+func (b *upstreamBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.finish(nil)
+	return err
+}
+
+// finish report the failure of the response, or the read error once
+func (b *upstreamBody) finish(err error) {
+	b.once.Do(func() {
+		if b.failure != nil {
+			err = b.failure
+		} else if b.ctx.Err() != nil {
+			err = nil
+		}
+		b.done(err)
+	})
+}
+
+// next select an upstream except the tried ones
+//
+// note: the HashBalancer skips the excluded items on the ring, so the retries
+// keep the key affinity among the rest items, and never rebuild the ring.
+func (p *Proxy) next(req *http.Request, tried map[Item]bool) *Upstream {
+	items := p.items
+	if len(tried) > 0 {
+		items = make([]Item, 0, len(p.items))
+		for _, item := range p.items {
+			if !tried[item] {
+				items = append(items, item)
+			}
+		}
+	}
+
+	var item Item
+	if hb, ok := p.b.(HashBalancer); ok && p.opts.HashKey != nil {
+		item = hb.NextKey(p.opts.HashKey(req), items)
+	} else {
+		item = p.b.Next(items)
+	}
+
+	if item == nil {
+		return nil
+	}
+	return item.(*Upstream)
+}
+
+func (p *Proxy) errorHandler(w http.ResponseWriter, r *http.Request, err error) {
+	if err == ErrNoUpstream {
+		http.Error(w, err.Error(), http.StatusServiceUnavailable)
+		return
+	}
+	http.Error(w, err.Error(), http.StatusBadGateway)
+}
+
+// retriable check if the request could be safely sent again:
+// the idempotent method without body
+func retriable(req *http.Request) bool {
+	switch req.Method {
+	case "GET", "HEAD", "OPTIONS", "TRACE", "PUT", "DELETE":
+	default:
+		return false
+	}
+	return req.Body == nil || req.Body == http.NoBody
+}
+
+// rewriteURL rewrite the request url to the upstream, the upstream's path is used as the prefix
+func rewriteURL(upstream, u *url.URL) *url.URL {
+	out := *u
+	out.Scheme = upstream.Scheme
+	out.Host = upstream.Host
+
+	switch a, b := strings.HasSuffix(upstream.Path, "/"), strings.HasPrefix(u.Path, "/"); {
+	case a && b:
+		out.Path = upstream.Path + u.Path[1:]
+	case !a && !b:
+		out.Path = upstream.Path + "/" + u.Path
+	default:
+		out.Path = upstream.Path + u.Path
+	}
+	out.RawPath = ""
+
+	if upstream.RawQuery != "" && u.RawQuery != "" {
+		out.RawQuery = upstream.RawQuery + "&" + u.RawQuery
+	} else if upstream.RawQuery != "" {
+		out.RawQuery = upstream.RawQuery
+	}
+	return &out
+}
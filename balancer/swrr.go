@@ -0,0 +1,75 @@
+package balancer
+
+import "sync"
+
+// swrrBalancer is the smooth weighted round robin balancer as nginx does:
+// on each Next, every item's current weight increases by its weight, the item
+// with the highest current weight is selected and then decreased by the total
+// weight. eg: weights {a:5, b:1, c:1} gives `a a b a c a a` rather than `a a a a a b c`.
+//
+// note: the items are used as map keys to hold their current weights, so they
+// must be comparable, eg: pointers. the items could be added / removed between
+// Next calls, the current weights of the rest items are kept.
+type swrrBalancer struct {
+	sync.Mutex                    // protect followings
+	peers      map[Item]*swrrPeer // current weights of each item
+	gen        uint64             // generation of Next calls, to sweep the removed items
+}
+
+type swrrPeer struct {
+	current int    // current weight
+	gen     uint64 // the generation of last seen
+}
+
+func (b *swrrBalancer) Next(items []Item) Item {
+	if len(items) == 0 {
+		return nil
+	}
+
+	b.Lock()
+	defer b.Unlock()
+
+	b.gen++
+
+	var (
+		best  *swrrPeer
+		bestN Item
+		total int
+	)
+	for _, item := range items {
+		w := absWeight(item)
+		if w == 0 { // disabled
+			continue
+		}
+
+		peer, ok := b.peers[item]
+		if !ok {
+			peer = new(swrrPeer)
+			b.peers[item] = peer
+		}
+		peer.gen = b.gen
+		peer.current += w
+		total += w
+
+		if best == nil || peer.current > best.current {
+			best, bestN = peer, item
+		}
+	}
+
+	// sweep the removed items
+	if len(b.peers) > len(items) {
+		for item, peer := range b.peers {
+			if peer.gen != b.gen {
+				delete(b.peers, item)
+			}
+		}
+	}
+
+	// if all of weight value equals 0, return nil
+	if best == nil {
+		return nil
+	}
+
+	best.current -= total
+	return bestN
+}
@@ -0,0 +1,30 @@
+package httpmux
+
+import (
+	rate "../rate-limit"
+)
+
+// RateLimit return a midware which limits the requests by the http limiters in
+// order, the over-limit requests are rejected with 429 and the following limiters,
+// midwares & handlers are aborted, the standard rate limit headers are always set
+// by the latest checked limiter.
+//
+// eg: limit 100 requests per minute per client ip, and 1000 per hour per api key
+//
+//	byIP := rate.NewHTTPLimiter(rate.NewKeyedLimiter(time.Minute, 100, nil), rate.KeyByIP)
+//	byKey := rate.NewHTTPLimiter(rate.NewKeyedLimiter(time.Hour, 1000, nil), rate.KeyByHeader("X-API-Key"))
+//	mux.SetGlobalPreMidware(httpmux.RateLimit(byIP, byKey))
+//
+// note: the midwares are identified by the func name, so only the first RateLimit
+// midware set takes effect, all of the limiters must be passed in one call.
+func RateLimit(ls ...*rate.HTTPLimiter) HandleFunc {
+	return func(ctx *Context) {
+		for _, l := range ls {
+			if !l.Allow(ctx.Res, ctx.Req) {
+				ctx.TooManyRequests(rate.ErrNoMoreTokens)
+				ctx.Abort()
+				return
+			}
+		}
+	}
+}
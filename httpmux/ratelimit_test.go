@@ -0,0 +1,107 @@
+package httpmux
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	rate "../rate-limit"
+	check "gopkg.in/check.v1"
+)
+
+type httpmuxSuit struct{}
+
+var _ = check.Suite(new(httpmuxSuit))
+
+func TestHTTPMux(t *testing.T) {
+	check.TestingT(t)
+}
+
+func (s *httpmuxSuit) TestRateLimit(c *check.C) {
+	var (
+		k       = rate.NewKeyedLimiter(time.Minute, 2, &rate.KeyedOptions{New: rate.NewLimiter})
+		l       = rate.NewHTTPLimiter(k, rate.KeyByHeader("X-API-Key"))
+		mux     = New("")
+		handled int
+	)
+	mux.SetGlobalPreMidware(RateLimit(l))
+	mux.GET("/ping", func(ctx *Context) {
+		handled++
+		ctx.Text(http.StatusOK, "pong")
+	})
+
+	do := func(key, ip string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/ping", nil)
+		req.RemoteAddr = ip + ":12345"
+		if key != "" {
+			req.Header.Set("X-API-Key", key)
+		}
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w
+	}
+
+	// within the limit, the headers are set
+	for i := 0; i < 2; i++ {
+		w := do("a", "10.0.0.1")
+		c.Assert(w.Code, check.Equals, http.StatusOK)
+		c.Assert(w.Body.String(), check.Equals, "pong")
+		c.Assert(w.Header().Get("RateLimit-Limit"), check.Equals, "2")
+		c.Assert(w.Header().Get("RateLimit-Remaining"), check.Equals, []string{"1", "0"}[i])
+	}
+	c.Assert(handled, check.Equals, 2)
+
+	// over the limit, rejected with 429 and the handlers are aborted
+	w := do("a", "10.0.0.2")
+	c.Assert(w.Code, check.Equals, http.StatusTooManyRequests)
+	c.Assert(w.Header().Get("RateLimit-Remaining"), check.Equals, "0")
+	c.Assert(w.Header().Get("Retry-After") != "", check.Equals, true)
+	var body HTTPError
+	c.Assert(json.NewDecoder(w.Body).Decode(&body), check.IsNil)
+	c.Assert(body.Error, check.Equals, rate.ErrNoMoreTokens.Error())
+	c.Assert(handled, check.Equals, 2)
+
+	// the requests without the key are limited by the client ip
+	c.Assert(do("", "10.0.0.1").Code, check.Equals, http.StatusOK)
+	c.Assert(do("", "10.0.0.2").Code, check.Equals, http.StatusOK)
+	c.Assert(do("", "10.0.0.2").Code, check.Equals, http.StatusOK)
+	c.Assert(do("", "10.0.0.2").Code, check.Equals, http.StatusTooManyRequests)
+	c.Assert(handled, check.Equals, 5)
+}
+
+func (s *httpmuxSuit) TestRateLimitMulti(c *check.C) {
+	var (
+		byIP  = rate.NewHTTPLimiter(rate.NewKeyedLimiter(time.Minute, 3, &rate.KeyedOptions{New: rate.NewLimiter}), rate.KeyByIP)
+		byKey = rate.NewHTTPLimiter(rate.NewKeyedLimiter(time.Minute, 2, &rate.KeyedOptions{New: rate.NewLimiter}), rate.KeyByHeader("X-API-Key"))
+		mux   = New("")
+	)
+	mux.SetGlobalPreMidware(RateLimit(byIP, byKey))
+	mux.GET("/ping", func(ctx *Context) {
+		ctx.Text(http.StatusOK, "pong")
+	})
+
+	do := func(key, ip string) int {
+		req := httptest.NewRequest("GET", "/ping", nil)
+		req.RemoteAddr = ip + ":12345"
+		req.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		mux.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// limited by the api key across the ips
+	c.Assert(do("a", "10.0.0.1"), check.Equals, http.StatusOK)
+	c.Assert(do("a", "10.0.0.2"), check.Equals, http.StatusOK)
+	c.Assert(do("a", "10.0.0.3"), check.Equals, http.StatusTooManyRequests)
+
+	// limited by the ip across the api keys
+	c.Assert(do("b", "10.0.0.1"), check.Equals, http.StatusOK)
+	c.Assert(do("c", "10.0.0.1"), check.Equals, http.StatusOK)
+	c.Assert(do("d", "10.0.0.1"), check.Equals, http.StatusTooManyRequests)
+
+	// the second RateLimit midware is dropped as the same func name
+	mux.SetGlobalPreMidware(RateLimit(byKey))
+	c.Assert(mux.PreMidwares, check.HasLen, 1)
+}
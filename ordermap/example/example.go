@@ -4,11 +4,13 @@ import (
 	"encoding/json"
 	"fmt"
 	"os"
+	"strings"
 
 	"../../ordermap"
 )
 
 func main() {
+	// the insertion order
 	m := ordermap.New()
 	m.Set("n", 100)
 	m.Set("f", 99.99)
@@ -27,4 +29,18 @@ func main() {
 		fmt.Println(key, m.Get(key))
 	}
 	json.NewEncoder(os.Stdout).Encode(m)
+
+	// the lexicographical order
+	m = ordermap.NewSorted()
+	m.Set("n", 100)
+	m.Set("f", 99.99)
+	m.Set("a", "foo")
+	json.NewEncoder(os.Stdout).Encode(m)
+
+	// the custom order: case insensitive
+	m = ordermap.NewWithLess(func(a, b string) bool { return strings.ToLower(a) < strings.ToLower(b) })
+	m.Set("b", "bar")
+	m.Set("C", "foobar")
+	m.Set("A", "foo")
+	json.NewEncoder(os.Stdout).Encode(m)
 }
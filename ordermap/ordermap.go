@@ -1,51 +1,128 @@
 package ordermap
 
 import (
+	"container/list"
 	"encoding/json"
 	"sort"
 )
 
+// OrderMap is a map with ordered keys, the keys are ordered by the insertion
+// order by default, or sorted by the comparator, see NewSorted, NewWithLess
+//
+// note: it's not safe for concurrent use.
 type OrderMap struct {
-	m    map[string]interface{} // origin map
-	keys []string               // ordered keys
+	m     map[string]*list.Element // origin map, key -> element of the entries list
+	l     *list.List               // entries in insertion order
+	less  func(a, b string) bool   // the comparator of the keys, nil means the insertion order
+	elems []*list.Element          // the index of the entries list for Less & Swap, nil once changed
 }
 
+type entry struct {
+	key   string
+	value interface{}
+}
+
+// New new an OrderMap, the keys are ordered by the insertion order, the
+// update of an existing key keeps its original position
 func New() *OrderMap {
+	return NewWithLess(nil)
+}
+
+// NewSorted new an OrderMap, the keys are sorted lexicographically
+func NewSorted() *OrderMap {
+	return NewWithLess(func(a, b string) bool { return a < b })
+}
+
+// NewWithLess new an OrderMap, the keys are sorted by the comparator,
+// the keys equal by the comparator are kept in the insertion order
+func NewWithLess(less func(a, b string) bool) *OrderMap {
 	return &OrderMap{
-		m:    make(map[string]interface{}),
-		keys: make([]string, 0),
+		m:    make(map[string]*list.Element),
+		l:    list.New(),
+		less: less,
 	}
 }
 
 func (o *OrderMap) Get(key string) interface{} {
-	return o.m[key]
+	if elem, ok := o.m[key]; ok {
+		return elem.Value.(*entry).value
+	}
+	return nil
 }
 
 func (o *OrderMap) Set(key string, value interface{}) {
 	if key == "" || value == nil {
 		return
 	}
-	if _, ok := o.m[key]; ok {
-		o.m[key] = value
+	if elem, ok := o.m[key]; ok {
+		elem.Value.(*entry).value = value
 	} else {
-		o.m[key] = value
-		o.keys = append(o.keys, key)
+		o.m[key] = o.l.PushBack(&entry{key, value})
+		o.elems = nil
 	}
 }
 
+// Del remove the key in O(1)
 func (o *OrderMap) Del(key string) {
-	delete(o.m, key)
-	for idx, val := range o.keys {
-		if val == key {
-			o.keys = append(o.keys[:idx], o.keys[idx+1:]...) // remove from slice
-		}
+	if elem, ok := o.m[key]; ok {
+		o.l.Remove(elem)
+		delete(o.m, key)
+		o.elems = nil
 	}
 }
 
-// Keys return the ordered keys of params map
+// Len return the nb of keys
+func (o *OrderMap) Len() int {
+	return len(o.m)
+}
+
+// Keys return a copy of the ordered keys, the OrderMap is not changed
 func (o *OrderMap) Keys() []string {
-	sort.Sort(o)
-	return o.keys
+	keys := make([]string, 0, len(o.m))
+	for elem := o.l.Front(); elem != nil; elem = elem.Next() {
+		keys = append(keys, elem.Value.(*entry).key)
+	}
+
+	if o.less != nil {
+		sort.SliceStable(keys, func(i, j int) bool { return o.less(keys[i], keys[j]) })
+	}
+	return keys
+}
+
+// Less report if the i-th key is lexicographically less than the j-th key,
+// both are indexed in the insertion order
+//
+// Deprecated: the keys are sorted by NewSorted or NewWithLess, Less & Swap
+// are kept for sort.Sort(o) to sort the insertion order in place, the index
+// of the entries is built in O(n) once the keys changed, and reused by the sort.
+func (o *OrderMap) Less(i, j int) bool {
+	return o.elem(i).Value.(*entry).key < o.elem(j).Value.(*entry).key
+}
+
+// Swap swap the i-th & j-th keys in the insertion order
+//
+// Deprecated: see Less.
+func (o *OrderMap) Swap(i, j int) {
+	ei, ej := o.elem(i), o.elem(j)
+	ei.Value, ej.Value = ej.Value, ei.Value
+	o.m[ei.Value.(*entry).key] = ei
+	o.m[ej.Value.(*entry).key] = ej
+}
+
+// elem return the i-th element of the entries list, it panics if out of range
+//
+// note: Swap only swaps the values of the elements, so the index is kept
+func (o *OrderMap) elem(i int) *list.Element {
+	if i < 0 || i >= o.l.Len() {
+		panic("ordermap: index out of range")
+	}
+	if o.elems == nil {
+		o.elems = make([]*list.Element, 0, o.l.Len())
+		for elem := o.l.Front(); elem != nil; elem = elem.Next() {
+			o.elems = append(o.elems, elem)
+		}
+	}
+	return o.elems[i]
 }
 
 // MarshalJSON implement json.Marshaler
@@ -63,16 +140,3 @@ func (o *OrderMap) MarshalJSON() ([]byte, error) {
 
 	return json.Marshal(OrderMap)
 }
-
-// implement sort.Interface
-func (o *OrderMap) Len() int {
-	return len(o.keys)
-}
-
-func (o *OrderMap) Less(i int, j int) bool {
-	return o.keys[i] < o.keys[j]
-}
-
-func (o *OrderMap) Swap(i int, j int) {
-	o.keys[i], o.keys[j] = o.keys[j], o.keys[i]
-}
@@ -0,0 +1,175 @@
+package ordermap
+
+import (
+	"encoding/json"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+
+	check "gopkg.in/check.v1"
+)
+
+type ordermapSuit struct{}
+
+var _ = check.Suite(new(ordermapSuit))
+
+func TestOrderMap(t *testing.T) {
+	check.TestingT(t)
+}
+
+func (s *ordermapSuit) TestInsertionOrder(c *check.C) {
+	m := New()
+	for i, key := range []string{"n", "f", "d", "c", "b", "a"} {
+		m.Set(key, i)
+	}
+	c.Assert(m.Len(), check.Equals, 6)
+	c.Assert(m.Keys(), check.DeepEquals, []string{"n", "f", "d", "c", "b", "a"})
+	c.Assert(m.Get("d"), check.Equals, 2)
+	c.Assert(m.Get("x"), check.IsNil)
+
+	// the empty key & nil value are ignored
+	m.Set("", 1)
+	m.Set("x", nil)
+	c.Assert(m.Len(), check.Equals, 6)
+
+	bs, err := json.Marshal(m)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(bs), check.Equals, `[{"key":"n","val":0},{"key":"f","val":1},{"key":"d","val":2},{"key":"c","val":3},{"key":"b","val":4},{"key":"a","val":5}]`)
+}
+
+func (s *ordermapSuit) TestUpdateKeepsPosition(c *check.C) {
+	m := New()
+	m.Set("a", 1)
+	m.Set("b", 2)
+	m.Set("c", 3)
+
+	m.Set("a", 10)
+	m.Set("b", 20)
+	c.Assert(m.Keys(), check.DeepEquals, []string{"a", "b", "c"})
+	c.Assert(m.Get("a"), check.Equals, 10)
+	c.Assert(m.Get("b"), check.Equals, 20)
+	c.Assert(m.Len(), check.Equals, 3)
+
+	// re-inserted after the deletion goes to the end
+	m.Del("a")
+	m.Set("a", 100)
+	c.Assert(m.Keys(), check.DeepEquals, []string{"b", "c", "a"})
+}
+
+func (s *ordermapSuit) TestDel(c *check.C) {
+	m := New()
+	for i, key := range []string{"a", "b", "c", "d", "e"} {
+		m.Set(key, i)
+	}
+
+	// the middle
+	m.Del("c")
+	c.Assert(m.Keys(), check.DeepEquals, []string{"a", "b", "d", "e"})
+	c.Assert(m.Get("c"), check.IsNil)
+
+	// the head & tail
+	m.Del("a")
+	m.Del("e")
+	c.Assert(m.Keys(), check.DeepEquals, []string{"b", "d"})
+	c.Assert(m.Len(), check.Equals, 2)
+
+	// the missing key is ignored
+	m.Del("x")
+	m.Del("a")
+	c.Assert(m.Keys(), check.DeepEquals, []string{"b", "d"})
+
+	// all
+	m.Del("b")
+	m.Del("d")
+	c.Assert(m.Len(), check.Equals, 0)
+	c.Assert(m.Keys(), check.DeepEquals, []string{})
+	bs, err := json.Marshal(m)
+	c.Assert(err, check.IsNil)
+	c.Assert(string(bs), check.Equals, `[]`)
+}
+
+func (s *ordermapSuit) TestSorted(c *check.C) {
+	m := NewSorted()
+	for i, key := range []string{"n", "f", "d", "c", "b", "a"} {
+		m.Set(key, i)
+	}
+	c.Assert(m.Keys(), check.DeepEquals, []string{"a", "b", "c", "d", "f", "n"})
+
+	m.Del("c")
+	m.Set("e", 6)
+	m.Set("a", 7)
+	c.Assert(m.Keys(), check.DeepEquals, []string{"a", "b", "d", "e", "f", "n"})
+	c.Assert(m.Get("a"), check.Equals, 7)
+}
+
+func (s *ordermapSuit) TestStableLess(c *check.C) {
+	// case insensitive, the equal keys are kept in the insertion order
+	m := NewWithLess(func(a, b string) bool { return strings.ToLower(a) < strings.ToLower(b) })
+	for i, key := range []string{"b", "C", "a", "B", "A", "c"} {
+		m.Set(key, i)
+	}
+	c.Assert(m.Keys(), check.DeepEquals, []string{"a", "A", "b", "B", "C", "c"})
+
+	// the update keeps the position among the equal keys
+	m.Set("b", 10)
+	c.Assert(m.Keys(), check.DeepEquals, []string{"a", "A", "b", "B", "C", "c"})
+
+	m.Del("b")
+	m.Set("b", 11)
+	c.Assert(m.Keys(), check.DeepEquals, []string{"a", "A", "B", "b", "C", "c"})
+}
+
+func (s *ordermapSuit) TestKeysCopy(c *check.C) {
+	for _, m := range []*OrderMap{New(), NewSorted()} {
+		m.Set("a", 1)
+		m.Set("b", 2)
+
+		keys := m.Keys()
+		keys[0], keys[1] = "x", "y"
+		c.Assert(m.Keys(), check.DeepEquals, []string{"a", "b"})
+		c.Assert(m.Get("x"), check.IsNil)
+	}
+}
+
+func (s *ordermapSuit) TestDeprecatedSort(c *check.C) {
+	m := New()
+	for i, key := range []string{"n", "f", "d", "c", "b", "a"} {
+		m.Set(key, i)
+	}
+	c.Assert(m.Less(5, 0), check.Equals, true)
+	c.Assert(m.Less(0, 5), check.Equals, false)
+
+	// sort the insertion order in place, the values follow the keys
+	sort.Sort(m)
+	c.Assert(m.Keys(), check.DeepEquals, []string{"a", "b", "c", "d", "f", "n"})
+	c.Assert(m.Get("a"), check.Equals, 5)
+	c.Assert(m.Get("n"), check.Equals, 0)
+
+	m.Del("c")
+	m.Set("e", 6)
+	c.Assert(m.Keys(), check.DeepEquals, []string{"a", "b", "d", "f", "n", "e"})
+	c.Assert(func() { m.Swap(0, 6) }, check.PanicMatches, "ordermap: index out of range")
+
+	// the index is rebuilt once the keys changed
+	sort.Sort(sort.Reverse(m))
+	c.Assert(m.Keys(), check.DeepEquals, []string{"n", "f", "e", "d", "b", "a"})
+	c.Assert(m.Get("e"), check.Equals, 6)
+	m.Del("n")
+	c.Assert(m.Less(4, 0), check.Equals, true)
+	c.Assert(func() { m.Swap(0, 5) }, check.PanicMatches, "ordermap: index out of range")
+}
+
+func BenchmarkDeprecatedSort(b *testing.B) {
+	keys := make([]string, 1000)
+	for i := range keys {
+		keys[i] = strconv.Itoa(i * 7919 % len(keys))
+	}
+	for i := 0; i < b.N; i++ {
+		m := New()
+		for _, key := range keys {
+			m.Set(key, i)
+		}
+		sort.Sort(m)
+	}
+}
@@ -0,0 +1,280 @@
+package rate
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+// AdaptiveOptions is the optional settings of the adaptive concurrency limiters
+type AdaptiveOptions struct {
+	// InitialLimit is the limit of the in-flight work at start, default 20
+	InitialLimit int
+	// MinLimit & MaxLimit bound the limit, default 1 & 1000
+	MinLimit int
+	MaxLimit int
+	// Backoff is the ratio to decrease the limit on each failed work, default 0.9
+	Backoff float64
+
+	// Timeout is used by AIMD, the work slower than it is treated as failed, 0 disables
+	Timeout time.Duration
+
+	// Alpha & Beta are used by Vegas, the limit increases if the estimated queue
+	// is less than Alpha, and decreases if greater than Beta, default 3 & 6
+	Alpha int
+	Beta  int
+	// ProbeRounds is used by Vegas, the no-load latency is re-probed after each
+	// ProbeRounds rounds of the work, default 30, negative disables
+	ProbeRounds int
+}
+
+func (o *AdaptiveOptions) defaults() {
+	if o.MinLimit <= 0 {
+		o.MinLimit = 1
+	}
+	if o.MaxLimit <= 0 {
+		o.MaxLimit = 1000
+	}
+	if o.MaxLimit < o.MinLimit {
+		o.MaxLimit = o.MinLimit
+	}
+	if o.InitialLimit <= 0 {
+		o.InitialLimit = 20
+	}
+	if o.Backoff <= 0 || o.Backoff >= 1 {
+		o.Backoff = 0.9
+	}
+	if o.Alpha <= 0 {
+		o.Alpha = 3
+	}
+	if o.Beta <= o.Alpha {
+		o.Beta = o.Alpha * 2
+	}
+	if o.ProbeRounds == 0 {
+		o.ProbeRounds = 30
+	}
+}
+
+// NewAIMD new an additive increase / multiplicative decrease concurrency limiter:
+// the limit increases by 1 after each limit nb of successful work, and decreases by
+// the Backoff ratio on each failed or timed out work, as TCP congestion control does.
+func NewAIMD(opts *AdaptiveOptions) ConcurrencyLimiter {
+	l := &aimdLimiter{}
+	l.init(opts)
+	return l
+}
+
+// NewVegas new a Vegas style concurrency limiter: it estimates the queue of the
+// downstream by the gradient of the no-load latency to the current latency:
+// queue = limit * (1 - min latency / latency), the limit increases if the queue
+// is less than Alpha, decreases if greater than Beta, and decreases by the Backoff
+// ratio on each failed work. so it backs off before the errors, once the latency rises.
+//
+// note: the no-load latency is the min latency observed, and it's re-probed after
+// each ProbeRounds rounds of the work: the in-flight work is halved for one round,
+// and the min latency of the round replaces it, so it follows the downstream once
+// its base latency shifts. the reported Limit is kept during the probe.
+func NewVegas(opts *AdaptiveOptions) ConcurrencyLimiter {
+	l := &vegasLimiter{}
+	l.init(opts)
+	return l
+}
+
+// adaptive is the base of the adaptive concurrency limiters
+type adaptive struct {
+	opts AdaptiveOptions
+
+	sync.Mutex         // protect followings
+	limit      float64 // current limit, the fraction part accumulates the increases
+	inflight   int     // nb of in-flight work
+	recovering int     // nb of the work sent before the latest backoff, still in-flight
+}
+
+func (a *adaptive) init(opts *AdaptiveOptions) {
+	if opts != nil {
+		a.opts = *opts
+	}
+	a.opts.defaults()
+	a.setLimit(float64(a.opts.InitialLimit))
+}
+
+// Acquire implement ConcurrencyLimiter interface
+func (a *adaptive) Acquire() error {
+	a.Lock()
+	defer a.Unlock()
+	return a.acquire(int(a.limit))
+}
+
+// Limit implement ConcurrencyLimiter interface
+func (a *adaptive) Limit() int {
+	a.Lock()
+	defer a.Unlock()
+	return int(a.limit)
+}
+
+// InFlight implement ConcurrencyLimiter interface
+func (a *adaptive) InFlight() int {
+	a.Lock()
+	defer a.Unlock()
+	return a.inflight
+}
+
+func (a *adaptive) string(name string) string {
+	a.Lock()
+	defer a.Unlock()
+	return fmt.Sprintf("%s limit %d in-flight, current in-flight %d", name, int(a.limit), a.inflight)
+}
+
+//
+// unsafe ops
+//
+
+func (a *adaptive) acquire(limit int) error {
+	if a.inflight >= limit {
+		return ErrNoMoreTokens
+	}
+	a.inflight++
+	return nil
+}
+
+// release the slot, and backoff if the work failed. it returns if the limit
+// was fully used before the release, the limit shouldn't increase if it's not,
+// eg: the load is low.
+//
+// note: the limit backs off at most once per round of the in-flight work, the
+// failures of the work sent before the latest backoff are ignored, as they were
+// caused by the stale limit, as the TCP fast recovery does.
+func (a *adaptive) release(failed bool) bool {
+	utilized := a.inflight*2 >= int(a.limit)
+	if a.inflight > 0 {
+		a.inflight--
+	}
+
+	switch {
+	case a.recovering > 0:
+		a.recovering--
+	case failed:
+		a.setLimit(a.limit * a.opts.Backoff)
+		a.recovering = a.inflight
+	}
+	return utilized
+}
+
+func (a *adaptive) setLimit(limit float64) {
+	if min := float64(a.opts.MinLimit); limit < min {
+		limit = min
+	}
+	if max := float64(a.opts.MaxLimit); limit > max {
+		limit = max
+	}
+	a.limit = limit
+}
+
+// aimdLimiter is the AIMD concurrency limiter
+type aimdLimiter struct {
+	adaptive
+}
+
+// Release implement ConcurrencyLimiter interface
+func (l *aimdLimiter) Release(latency time.Duration, err error) {
+	l.Lock()
+	defer l.Unlock()
+
+	failed := err != nil || l.opts.Timeout > 0 && latency > l.opts.Timeout
+	if utilized := l.release(failed); utilized && !failed {
+		l.setLimit(l.limit + 1/l.limit)
+	}
+}
+
+// String implement ConcurrencyLimiter interface
+func (l *aimdLimiter) String() string {
+	return l.string("aimd")
+}
+
+// vegasLimiter is the Vegas style concurrency limiter
+type vegasLimiter struct {
+	adaptive
+
+	// protected by the lock
+	minLatency time.Duration // the no-load latency
+	samples    int           // nb of the samples since the latest probe
+	probing    bool          // if the no-load latency is being probed
+	probeSkip  int           // nb of the work sent before the probe, still in-flight
+	probeMin   time.Duration // the min latency of the probe
+	probeCount int           // nb of the samples of the probe
+}
+
+// Acquire implement ConcurrencyLimiter interface
+func (l *vegasLimiter) Acquire() error {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.probing {
+		return l.acquire(l.probeLimit())
+	}
+	return l.acquire(int(l.limit))
+}
+
+// Release implement ConcurrencyLimiter interface
+func (l *vegasLimiter) Release(latency time.Duration, err error) {
+	l.Lock()
+	defer l.Unlock()
+
+	utilized := l.release(err != nil)
+	if l.probing && l.probeSkip > 0 {
+		l.probeSkip-- // queued by the work sent before the probe
+		return
+	}
+	if err != nil || latency <= 0 {
+		return
+	}
+	if l.probing {
+		l.probe(latency)
+		return
+	}
+	if l.minLatency == 0 || latency < l.minLatency {
+		l.minLatency = latency
+	}
+
+	// the limit changes by 1 after each limit nb of work
+	queue := l.limit * (1 - float64(l.minLatency)/float64(latency))
+	switch {
+	case queue > float64(l.opts.Beta):
+		l.setLimit(l.limit - 1/l.limit)
+	case queue < float64(l.opts.Alpha) && utilized:
+		l.setLimit(l.limit + 1/l.limit)
+	}
+
+	l.samples++
+	if l.opts.ProbeRounds > 0 && l.samples >= l.opts.ProbeRounds*int(l.limit) {
+		l.probing = true
+		l.probeSkip = l.inflight
+		l.probeMin, l.probeCount = 0, 0
+	}
+}
+
+// String implement ConcurrencyLimiter interface
+func (l *vegasLimiter) String() string {
+	return l.string("vegas")
+}
+
+// the in-flight work is halved during the probe, so it's not queued
+func (l *vegasLimiter) probeLimit() int {
+	if limit := int(l.limit) / 2; limit > l.opts.MinLimit {
+		return limit
+	}
+	return l.opts.MinLimit
+}
+
+// probe take the min latency of one round of the probe as the no-load latency
+func (l *vegasLimiter) probe(latency time.Duration) {
+	if l.probeMin == 0 || latency < l.probeMin {
+		l.probeMin = latency
+	}
+	l.probeCount++
+	if l.probeCount >= l.probeLimit() {
+		l.minLatency = l.probeMin
+		l.probing = false
+		l.samples = 0
+	}
+}
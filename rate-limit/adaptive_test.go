@@ -0,0 +1,188 @@
+package rate
+
+import (
+	"container/heap"
+	"errors"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+func (s *rateSuit) TestAdaptiveBasic(c *check.C) {
+	for name, l := range map[string]ConcurrencyLimiter{
+		"aimd":  NewAIMD(&AdaptiveOptions{InitialLimit: 2, Timeout: time.Second}),
+		"vegas": NewVegas(&AdaptiveOptions{InitialLimit: 2}),
+	} {
+		c.Log(name)
+
+		// capped by the limit
+		c.Assert(l.Acquire(), check.IsNil)
+		c.Assert(l.Acquire(), check.IsNil)
+		c.Assert(l.Acquire(), check.Equals, ErrNoMoreTokens)
+		c.Assert(l.InFlight(), check.Equals, 2)
+		c.Assert(l.String(), check.Equals, name+" limit 2 in-flight, current in-flight 2")
+
+		// decreased on errors, but no less than the min limit
+		l.Release(time.Millisecond, errors.New("failed"))
+		l.Release(time.Millisecond, errors.New("failed"))
+		c.Assert(l.Limit(), check.Equals, 1)
+		c.Assert(l.InFlight(), check.Equals, 0)
+
+		// increased by the successful work under load
+		for i := 0; i < 10; i++ {
+			c.Assert(l.Acquire(), check.IsNil)
+			l.Release(time.Millisecond, nil)
+		}
+		c.Assert(l.Limit() > 1, check.Equals, true)
+	}
+}
+
+// the downstream of the simulation: it serves capacity nb of work concurrently
+// in the base latency, the extra work is queued so the latency rises linearly,
+// and the work is failed once the in-flight work exceeds the max.
+type simDownstream struct {
+	capacity int
+	base     time.Duration
+	max      int
+}
+
+var errSimOverload = errors.New("overloaded")
+
+func (d simDownstream) serve(inflight int) (time.Duration, error) {
+	if inflight > d.max {
+		return d.base, errSimOverload
+	}
+	latency := d.base
+	if inflight > d.capacity {
+		latency = d.base * time.Duration(inflight) / time.Duration(d.capacity)
+	}
+	return latency, nil
+}
+
+type simWork struct {
+	finishAt time.Duration
+	latency  time.Duration
+	err      error
+}
+
+type simQueue []simWork
+
+func (q simQueue) Len() int            { return len(q) }
+func (q simQueue) Less(i, j int) bool  { return q[i].finishAt < q[j].finishAt }
+func (q simQueue) Swap(i, j int)       { q[i], q[j] = q[j], q[i] }
+func (q *simQueue) Push(x interface{}) { *q = append(*q, x.(simWork)) }
+func (q *simQueue) Pop() interface{} {
+	old := *q
+	w := old[len(old)-1]
+	*q = old[:len(old)-1]
+	return w
+}
+
+// simulate run the discrete event simulation on a virtual clock: the clients
+// always have more work than the limit, the work is sent to the downstream once
+// acquired, and released on finished. it returns the limits after each work.
+func simulate(l ConcurrencyLimiter, d simDownstream, works int) []int {
+	var (
+		now      time.Duration
+		inflight int
+		queue    = &simQueue{}
+		limits   = make([]int, 0, works)
+	)
+
+	for len(limits) < works {
+		// send the work as much as the limit allows
+		for l.Acquire() == nil {
+			inflight++
+			latency, err := d.serve(inflight)
+			heap.Push(queue, simWork{now + latency, latency, err})
+		}
+
+		// finish the earliest work
+		w := heap.Pop(queue).(simWork)
+		now = w.finishAt
+		inflight--
+		l.Release(w.latency, w.err)
+		limits = append(limits, l.Limit())
+	}
+
+	// drain the in-flight work
+	for queue.Len() > 0 {
+		w := heap.Pop(queue).(simWork)
+		l.Release(w.latency, w.err)
+	}
+
+	return limits
+}
+
+// the min & max of the limits
+func bounds(limits []int) (int, int) {
+	min, max := limits[0], limits[0]
+	for _, n := range limits {
+		if n < min {
+			min = n
+		}
+		if n > max {
+			max = n
+		}
+	}
+	return min, max
+}
+
+func (s *rateSuit) TestAdaptiveConvergence(c *check.C) {
+	d := simDownstream{capacity: 20, base: time.Millisecond * 10, max: 60}
+
+	for _, initial := range []int{1, 20, 200} {
+		// AIMD backs off once the latency exceeds the timeout: 25ms = 50 in-flight
+		aimd := simulate(NewAIMD(&AdaptiveOptions{InitialLimit: initial, Timeout: time.Millisecond * 25}), d, 20000)
+		min, max := bounds(aimd[10000:])
+		c.Logf("aimd from %d: converged in [%d, %d]", initial, min, max)
+		c.Assert(min >= 35 && max <= 55, check.Equals, true, check.Commentf("aimd from %d: [%d, %d]", initial, min, max))
+
+		// Vegas keeps the queue between alpha & beta: capacity + [3, 6]
+		vegas := simulate(NewVegas(&AdaptiveOptions{InitialLimit: initial}), d, 20000)
+		min, max = bounds(vegas[10000:])
+		c.Logf("vegas from %d: converged in [%d, %d]", initial, min, max)
+		c.Assert(min >= 20 && max <= 30, check.Equals, true, check.Commentf("vegas from %d: [%d, %d]", initial, min, max))
+	}
+}
+
+func (s *rateSuit) TestAdaptiveDownstreamSlowdown(c *check.C) {
+	var (
+		fast = simDownstream{capacity: 40, base: time.Millisecond * 10, max: 120}
+		slow = simDownstream{capacity: 10, base: time.Millisecond * 10, max: 30}
+		l    = NewVegas(nil)
+	)
+
+	// the limit follows the capacity of the downstream
+	limits := simulate(l, fast, 20000)
+	min, max := bounds(limits[10000:])
+	c.Assert(min >= 40 && max <= 50, check.Equals, true, check.Commentf("fast: [%d, %d]", min, max))
+
+	limits = simulate(l, slow, 20000)
+	min, max = bounds(limits[10000:])
+	c.Assert(min >= 10 && max <= 20, check.Equals, true, check.Commentf("slow: [%d, %d]", min, max))
+}
+
+func (s *rateSuit) TestAdaptiveBaseLatencyShift(c *check.C) {
+	var (
+		near = simDownstream{capacity: 20, base: time.Millisecond * 10, max: 60}
+		far  = simDownstream{capacity: 20, base: time.Millisecond * 50, max: 60}
+		l    = NewVegas(nil)
+	)
+
+	// the capacity is unchanged, so is the limit once the no-load latency
+	// is re-probed: capacity + [3, 6]
+	for i, d := range []simDownstream{near, far, near} {
+		limits := simulate(l, d, 20000)
+		min, max := bounds(limits[10000:])
+		c.Logf("base %s: converged in [%d, %d]", d.base, min, max)
+		c.Assert(min >= 20 && max <= 30, check.Equals, true, check.Commentf("#%d base %s: [%d, %d]", i, d.base, min, max))
+	}
+
+	// never re-probed, the raised base latency is taken as the queue
+	l = NewVegas(&AdaptiveOptions{ProbeRounds: -1})
+	simulate(l, near, 20000)
+	limits := simulate(l, far, 20000)
+	_, max := bounds(limits[10000:])
+	c.Assert(max < 20, check.Equals, true, check.Commentf("no probe: %d", max))
+}
@@ -0,0 +1,151 @@
+package rate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sync"
+	"time"
+)
+
+// NewTokenBucket new a token bucket limiter, the bucket holds at most n tokens
+// and is refilled at the rate of n tokens per w, so it allows bursts of n events
+// and a sustained rate of n events in w, with O(1) memory.
+func NewTokenBucket(w time.Duration, n int) Limiter {
+	l := &bucket{}
+	l.SetLimit(w, n)
+	return l
+}
+
+type bucket struct {
+	sync.Mutex               // protect followings
+	window     time.Duration // refill time window
+	limit      int           // bucket capacity, refilled limit tokens per window
+	tokens     float64       // available tokens at last
+	last       time.Time     // the time of last refill
+}
+
+// Take implement Limiter interface
+func (l *bucket) Take() error {
+	return l.TakeN(1)
+}
+
+// TakeN implement Limiter interface
+func (l *bucket) TakeN(n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	l.refill(time.Now())
+	if l.tokens < float64(n) {
+		return ErrNoMoreTokens
+	}
+
+	l.tokens -= float64(n)
+	return nil
+}
+
+// Wait implement Limiter interface
+func (l *bucket) Wait(ctx context.Context) error {
+	return wait(ctx, l)
+}
+
+// Reserve implement Limiter interface
+func (l *bucket) Reserve() time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	l.refill(time.Now())
+	if l.tokens >= 1 {
+		return 0
+	}
+	if l.limit == 0 {
+		return never
+	}
+
+	// the time to refill the missing part of one token
+	d := (1 - l.tokens) * float64(l.window) / float64(l.limit)
+	return time.Duration(math.Ceil(d))
+}
+
+// Remains implement Limiter interface
+func (l *bucket) Remains() int {
+	l.Lock()
+	defer l.Unlock()
+
+	l.refill(time.Now())
+	return int(l.tokens)
+}
+
+// Taken implement Limiter interface, the nb of tokens
+// taken but not refilled yet
+func (l *bucket) Taken() int {
+	l.Lock()
+	defer l.Unlock()
+
+	l.refill(time.Now())
+	return l.limit - int(l.tokens)
+}
+
+// SetLimit implement Limiter interface, the tokens taken
+// but not refilled yet are kept under the new limit
+func (l *bucket) SetLimit(w time.Duration, n int) {
+	l.Lock()
+	defer l.Unlock()
+
+	if w < 0 {
+		w = -w
+	}
+	if n < 0 {
+		n = -n
+	}
+
+	now := time.Now()
+	taken := 0.0 // a new bucket is full
+	if !l.last.IsZero() {
+		l.refill(now)
+		taken = float64(l.limit) - l.tokens
+	}
+	l.window = w
+	l.limit = n
+	l.last = now
+	l.tokens = float64(n) - taken
+	if l.tokens < 0 {
+		l.tokens = 0
+	}
+}
+
+// String implement Limiter interface
+func (l *bucket) String() string {
+	l.Lock()
+	defer l.Unlock()
+
+	l.refill(time.Now())
+	return fmt.Sprintf("token bucket limit %d tokens in %s, current remains %d", l.limit, l.window.String(), int(l.tokens))
+}
+
+//
+// unsafe ops
+//
+
+// refill add the tokens generated since the last refill
+func (l *bucket) refill(now time.Time) {
+	elapsed := now.Sub(l.last)
+	if elapsed <= 0 {
+		return
+	}
+	l.last = now
+
+	if l.window == 0 { // no window, always full
+		l.tokens = float64(l.limit)
+		return
+	}
+
+	l.tokens += float64(l.limit) * float64(elapsed) / float64(l.window)
+	if l.tokens > float64(l.limit) {
+		l.tokens = float64(l.limit)
+	}
+}
@@ -0,0 +1,239 @@
+package rate
+
+import (
+	"context"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Tier is one of the limits of the composite limiter: Limit tokens in Window
+type Tier struct {
+	Window time.Duration
+	Limit  int
+}
+
+func (t Tier) String() string {
+	return fmt.Sprintf("%d tokens in %s", t.Limit, t.Window.String())
+}
+
+// NewComposite new a limiter combines several tiers, eg: 10/s, 300/min and
+// 10k/day at the same time, the tokens are taken from all of the tiers or none
+// of them, each tier is a sliding log. a composite without tiers is unlimited.
+func NewComposite(tiers ...Tier) *Composite {
+	l := &Composite{}
+	l.SetTiers(tiers...)
+	return l
+}
+
+// Composite is the multi-tier limiter, see NewComposite
+type Composite struct {
+	sync.Mutex              // protect followings, and serialize the takes of all tiers
+	tiers      []*tierLimit // sorted by the window
+}
+
+type tierLimit struct {
+	Tier
+	l Limiter
+}
+
+// Take implement Limiter interface
+func (l *Composite) Take() error {
+	return l.TakeN(1)
+}
+
+// TakeN implement Limiter interface, take n tokens from all of the tiers or none
+func (l *Composite) TakeN(n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	// the tiers are only taken under the lock, so the remains
+	// checked won't decrease before the takes below
+	for _, t := range l.tiers {
+		if t.l.Remains() < n {
+			return ErrNoMoreTokens
+		}
+	}
+	for _, t := range l.tiers {
+		if err := t.l.TakeN(n); err != nil {
+			return err // never happen
+		}
+	}
+	return nil
+}
+
+// Wait implement Limiter interface
+func (l *Composite) Wait(ctx context.Context) error {
+	return wait(ctx, l)
+}
+
+// Reserve implement Limiter interface, the longest wait of the tiers
+func (l *Composite) Reserve() time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	var max time.Duration
+	for _, t := range l.tiers {
+		if d := t.l.Reserve(); d > max {
+			max = d
+		}
+	}
+	return max
+}
+
+// Remains implement Limiter interface, the remains of the binding tier
+func (l *Composite) Remains() int {
+	l.Lock()
+	defer l.Unlock()
+
+	t, remains := l.binding()
+	if t == nil {
+		return math.MaxInt32
+	}
+	return remains
+}
+
+// Taken implement Limiter interface, the taken of the binding tier
+func (l *Composite) Taken() int {
+	l.Lock()
+	defer l.Unlock()
+
+	t, remains := l.binding()
+	if t == nil {
+		return 0
+	}
+	return t.Limit - remains
+}
+
+// SetLimit implement Limiter interface, change the limit of the tier with
+// the window w on fly, the windows not in the tiers are ignored.
+//
+// note: use SetTiers & RemoveTier to change the tiers
+func (l *Composite) SetLimit(w time.Duration, n int) {
+	if w < 0 {
+		w = -w
+	}
+	if n < 0 {
+		n = -n
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	for _, t := range l.tiers {
+		if t.Window == w {
+			t.Limit = n
+			t.l.SetLimit(w, n)
+			return
+		}
+	}
+}
+
+// Tiers return the tiers sorted by the window
+func (l *Composite) Tiers() []Tier {
+	l.Lock()
+	defer l.Unlock()
+
+	tiers := make([]Tier, 0, len(l.tiers))
+	for _, t := range l.tiers {
+		tiers = append(tiers, t.Tier)
+	}
+	return tiers
+}
+
+// SetTiers replace the tiers on fly, the taken tokens of the tiers with
+// the same window are kept, the later one wins on the duplicated windows
+func (l *Composite) SetTiers(tiers ...Tier) {
+	l.Lock()
+	defer l.Unlock()
+
+	existing := make(map[time.Duration]*tierLimit, len(l.tiers))
+	for _, t := range l.tiers {
+		existing[t.Window] = t
+	}
+
+	next := make(map[time.Duration]*tierLimit, len(tiers))
+	for _, tier := range tiers {
+		if tier.Window < 0 {
+			tier.Window = -tier.Window
+		}
+		if tier.Limit < 0 {
+			tier.Limit = -tier.Limit
+		}
+
+		t, ok := next[tier.Window]
+		if !ok {
+			t, ok = existing[tier.Window]
+		}
+		if !ok {
+			t = &tierLimit{Tier: tier, l: NewLimiter(tier.Window, tier.Limit)}
+		} else if t.Limit != tier.Limit {
+			t.Limit = tier.Limit
+			t.l.SetLimit(tier.Window, tier.Limit)
+		}
+		next[tier.Window] = t
+	}
+
+	l.tiers = make([]*tierLimit, 0, len(next))
+	for _, t := range next {
+		l.tiers = append(l.tiers, t)
+	}
+	sort.Slice(l.tiers, func(i, j int) bool { return l.tiers[i].Window < l.tiers[j].Window })
+}
+
+// RemoveTier remove the tier with the window w on fly
+func (l *Composite) RemoveTier(w time.Duration) {
+	if w < 0 {
+		w = -w
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	for i, t := range l.tiers {
+		if t.Window == w {
+			l.tiers = append(l.tiers[:i], l.tiers[i+1:]...)
+			return
+		}
+	}
+}
+
+// String implement Limiter interface, report the binding tier
+// which has the least remains
+func (l *Composite) String() string {
+	l.Lock()
+	defer l.Unlock()
+
+	t, remains := l.binding()
+	if t == nil {
+		return "unlimited"
+	}
+
+	tiers := make([]string, 0, len(l.tiers))
+	for _, t := range l.tiers {
+		tiers = append(tiers, t.Tier.String())
+	}
+	return fmt.Sprintf("limit %s, binding %s, current remains %d", strings.Join(tiers, ", "), t.Tier.String(), remains)
+}
+
+// binding return the tier with the least remains, the ties are broken
+// by the longer window as it takes longer to regain, must be called under lock
+func (l *Composite) binding() (*tierLimit, int) {
+	var (
+		bind    *tierLimit
+		remains int
+	)
+	for _, t := range l.tiers {
+		if n := t.l.Remains(); bind == nil || n <= remains {
+			bind, remains = t, n
+		}
+	}
+	return bind, remains
+}
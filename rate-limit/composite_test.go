@@ -0,0 +1,73 @@
+package rate
+
+import (
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+func (s *rateSuit) TestComposite(c *check.C) {
+	l := NewComposite(Tier{time.Second, 5}, Tier{time.Millisecond * 100, 3})
+	tiers := l.tiers
+	c.Assert(l.Tiers(), check.DeepEquals, []Tier{{time.Millisecond * 100, 3}, {time.Second, 5}}) // sorted by the window
+
+	// the short tier binds the burst
+	c.Assert(l.TakeN(3), check.IsNil)
+	c.Assert(l.Take(), check.Equals, ErrNoMoreTokens)
+	c.Assert(l.Remains(), check.Equals, 0)
+	c.Assert(l.Taken(), check.Equals, 3)
+	c.Assert(l.String(), check.Equals, "limit 3 tokens in 100ms, 5 tokens in 1s, binding 3 tokens in 100ms, current remains 0")
+
+	// the long tier binds after the short one regained
+	time.Sleep(l.Reserve())
+	c.Assert(l.TakeN(2), check.IsNil)
+	c.Assert(tiers[0].l.Remains(), check.Equals, 1)
+	c.Assert(tiers[1].l.Remains(), check.Equals, 0)
+	c.Assert(l.String(), check.Equals, "limit 3 tokens in 100ms, 5 tokens in 1s, binding 5 tokens in 1s, current remains 0")
+
+	// take from all of the tiers or none
+	c.Assert(l.Take(), check.Equals, ErrNoMoreTokens)
+	c.Assert(tiers[0].l.Remains(), check.Equals, 1)
+	d := l.Reserve()
+	c.Assert(d > time.Millisecond*500 && d <= time.Second, check.Equals, true, check.Commentf("reserve %s", d))
+
+	// change the limit of the tier on fly, the unknown windows are ignored
+	l.SetLimit(time.Second, 6)
+	c.Assert(l.Take(), check.IsNil)
+	l.SetLimit(time.Hour, 100)
+	c.Assert(l.Tiers(), check.DeepEquals, []Tier{{time.Millisecond * 100, 3}, {time.Second, 6}})
+	c.Assert(l.Take(), check.Equals, ErrNoMoreTokens)
+}
+
+func (s *rateSuit) TestCompositeTiers(c *check.C) {
+	l := NewComposite(Tier{time.Second, 5}, Tier{time.Minute, 10})
+	c.Assert(l.TakeN(5), check.IsNil)
+	minute := l.tiers[1]
+
+	// replace the tiers, the taken tokens of the same window are kept
+	l.SetTiers(Tier{time.Minute, 8}, Tier{time.Hour, 100}, Tier{-time.Hour, 20})
+	c.Assert(l.Tiers(), check.DeepEquals, []Tier{{time.Minute, 8}, {time.Hour, 20}})
+	c.Assert(l.tiers[0], check.Equals, minute)
+	c.Assert(l.tiers[0].l.Taken(), check.Equals, 5)
+	c.Assert(l.tiers[1].l.Taken(), check.Equals, 0)
+	c.Assert(l.Remains(), check.Equals, 3)
+	c.Assert(l.TakeN(3), check.IsNil)
+	c.Assert(l.Take(), check.Equals, ErrNoMoreTokens)
+
+	// remove the tiers, the unknown windows are ignored
+	l.RemoveTier(time.Minute)
+	l.RemoveTier(time.Second)
+	c.Assert(l.Tiers(), check.DeepEquals, []Tier{{time.Hour, 20}})
+	c.Assert(l.Taken(), check.Equals, 3)
+	c.Assert(l.Take(), check.IsNil)
+
+	l.RemoveTier(-time.Hour)
+	c.Assert(l.Tiers(), check.HasLen, 0)
+	c.Assert(l.String(), check.Equals, "unlimited")
+
+	// no tiers, unlimited
+	l = NewComposite()
+	c.Assert(l.TakeN(1000), check.IsNil)
+	c.Assert(l.Reserve(), check.Equals, time.Duration(0))
+	c.Assert(l.String(), check.Equals, "unlimited")
+}
@@ -0,0 +1,257 @@
+package rate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// Store is the shared storage of the distributed limiters, it keeps the
+// events of each key in a sliding window, the limiters of several processes
+// sharing the same store & key are limited together.
+type Store interface {
+	// Take add n events of the key if the events in the latest window w plus n
+	// don't exceed the limit, atomically. it returns the nb of events in the
+	// window after the taking, and if the events are added.
+	Take(key string, w time.Duration, limit, n int) (count int, ok bool, err error)
+
+	// Count return the nb of events of the key in the latest window w
+	Count(key string, w time.Duration) (int, error)
+
+	// Reserve return how long to wait until the events of the key in the
+	// latest window w drop below the limit, 0 means available now
+	Reserve(key string, w time.Duration, limit int) (time.Duration, error)
+}
+
+// DistOptions is the optional settings of the distributed limiter
+type DistOptions struct {
+	// FailOpen allows the events if the store failed, default rejects them
+	FailOpen bool
+	// OnError is called on each store error, eg: to log it
+	OnError func(error)
+}
+
+// NewDistLimiter new a distributed limiter of the key on the store, all of the
+// limiters on the same store & key share the limit of n events in w, as a
+// sliding log does.
+//
+// note: the limit settings are not saved in the store, so all of
+// the limiters of the same key should use the same settings.
+func NewDistLimiter(store Store, key string, w time.Duration, n int, opts *DistOptions) Limiter {
+	o := DistOptions{}
+	if opts != nil {
+		o = *opts
+	}
+
+	l := &distLimiter{
+		store: store,
+		key:   key,
+		opts:  o,
+	}
+	l.SetLimit(w, n)
+	return l
+}
+
+type distLimiter struct {
+	store Store
+	key   string
+	opts  DistOptions
+
+	sync.RWMutex               // protect followings
+	window       time.Duration // token time window
+	limit        int           // token limit
+}
+
+// Take implement Limiter interface
+func (l *distLimiter) Take() error {
+	return l.TakeN(1)
+}
+
+// TakeN implement Limiter interface, the store errors are treated as
+// no more tokens, unless the FailOpen is set
+func (l *distLimiter) TakeN(n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	w, limit := l.settings()
+	if n > limit {
+		return ErrNoMoreTokens
+	}
+
+	_, ok, err := l.store.Take(l.key, w, limit, n)
+	if err != nil {
+		l.onError(err)
+		if l.opts.FailOpen {
+			return nil
+		}
+		return ErrNoMoreTokens
+	}
+	if !ok {
+		return ErrNoMoreTokens
+	}
+	return nil
+}
+
+// Wait implement Limiter interface
+func (l *distLimiter) Wait(ctx context.Context) error {
+	return wait(ctx, l)
+}
+
+// Reserve implement Limiter interface, if the store failed, wait
+// for a while as the whole window is taken
+func (l *distLimiter) Reserve() time.Duration {
+	w, limit := l.settings()
+	if limit == 0 {
+		return never
+	}
+
+	d, err := l.store.Reserve(l.key, w, limit)
+	if err != nil {
+		l.onError(err)
+		if l.opts.FailOpen {
+			return 0
+		}
+		return w / time.Duration(limit)
+	}
+	return d
+}
+
+// Remains implement Limiter interface
+func (l *distLimiter) Remains() int {
+	_, limit := l.settings()
+	n := limit - l.Taken()
+	if n < 0 {
+		n = 0
+	}
+	return n
+}
+
+// Taken implement Limiter interface, if the store failed,
+// the tokens are treated as all taken unless the FailOpen is set
+func (l *distLimiter) Taken() int {
+	w, limit := l.settings()
+
+	n, err := l.store.Count(l.key, w)
+	if err != nil {
+		l.onError(err)
+		if l.opts.FailOpen {
+			return 0
+		}
+		return limit
+	}
+	return n
+}
+
+// SetLimit implement Limiter interface
+func (l *distLimiter) SetLimit(w time.Duration, n int) {
+	l.Lock()
+	if w < 0 {
+		w = -w
+	}
+	if n < 0 {
+		n = -n
+	}
+	l.window = w
+	l.limit = n
+	l.Unlock()
+}
+
+// String implement Limiter interface
+func (l *distLimiter) String() string {
+	w, limit := l.settings()
+	return fmt.Sprintf("distributed limit %d tokens in %s on %q, current remains %d", limit, w.String(), l.key, l.Remains())
+}
+
+func (l *distLimiter) settings() (time.Duration, int) {
+	l.RLock()
+	defer l.RUnlock()
+	return l.window, l.limit
+}
+
+func (l *distLimiter) onError(err error) {
+	if l.opts.OnError != nil {
+		l.opts.OnError(err)
+	}
+}
+
+// NewMemoryStore new an in-process Store, it's useful for the tests, or
+// sharing the limits among the limiters of the same process
+func NewMemoryStore() Store {
+	return &memoryStore{
+		events: make(map[string][]time.Time),
+		now:    time.Now,
+	}
+}
+
+type memoryStore struct {
+	sync.Mutex                        // protect followings
+	events     map[string][]time.Time // the events of each key, oldest first
+	now        func() time.Time       // the clock, replaced by the tests
+}
+
+// Take implement Store interface
+func (s *memoryStore) Take(key string, w time.Duration, limit, n int) (int, bool, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.now()
+	events := s.gc(key, now, w)
+	if len(events)+n > limit {
+		return len(events), false, nil
+	}
+
+	for i := 0; i < n; i++ {
+		events = append(events, now)
+	}
+	s.events[key] = events
+	return len(events), true, nil
+}
+
+// Count implement Store interface
+func (s *memoryStore) Count(key string, w time.Duration) (int, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	return len(s.gc(key, s.now(), w)), nil
+}
+
+// Reserve implement Store interface
+func (s *memoryStore) Reserve(key string, w time.Duration, limit int) (time.Duration, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	now := s.now()
+	events := s.gc(key, now, w)
+	if len(events) < limit {
+		return 0, nil
+	}
+
+	// the oldest one beyond the limit - 1 line is outdated just after the window
+	d := events[len(events)-limit].Add(w).Sub(now) + 1
+	if d < 0 {
+		d = 0
+	}
+	return d, nil
+}
+
+// gc shift the outdated events of the key, the empty key is removed
+// to bound the memory, must be called under lock
+func (s *memoryStore) gc(key string, now time.Time, w time.Duration) []time.Time {
+	events := s.events[key]
+
+	outdated := now.Add(-w)
+	var n int
+	for n < len(events) && events[n].Before(outdated) {
+		n++
+	}
+	events = events[n:]
+
+	if len(events) == 0 {
+		delete(s.events, key)
+		return nil
+	}
+	s.events[key] = events
+	return events
+}
@@ -0,0 +1,527 @@
+package rate
+
+import (
+	"bufio"
+	"crypto/sha1"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+// fakeClock is the clock of the stores under control, so the events of each batch are timed exactly
+type fakeClock struct {
+	sync.Mutex
+	now time.Time
+}
+
+func newFakeClock() *fakeClock {
+	return &fakeClock{now: time.Unix(1600000000, 0)}
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.Lock()
+	defer c.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.Lock()
+	c.now = c.now.Add(d)
+	c.Unlock()
+}
+
+func (s *rateSuit) TestDistLimiterMemory(c *check.C) {
+	clock := newFakeClock()
+	store := NewMemoryStore()
+	store.(*memoryStore).now = clock.Now
+
+	// two limiters share the same key
+	l1 := NewDistLimiter(store, "api", time.Millisecond*200, 5, nil)
+	l2 := NewDistLimiter(store, "api", time.Millisecond*200, 5, nil)
+	other := NewDistLimiter(store, "other", time.Millisecond*200, 5, nil)
+
+	c.Assert(l1.TakeN(3), check.IsNil)
+	clock.Advance(time.Millisecond * 50)
+	c.Assert(l2.TakeN(3), check.Equals, ErrNoMoreTokens)
+	c.Assert(l2.TakeN(2), check.IsNil)
+	c.Assert(l1.Take(), check.Equals, ErrNoMoreTokens)
+	c.Assert(other.Take(), check.IsNil)
+
+	c.Assert(l1.Taken(), check.Equals, 5)
+	c.Assert(l2.Remains(), check.Equals, 0)
+	c.Assert(other.Taken(), check.Equals, 1)
+
+	// the 3 events of the first batch are outdated just after the window
+	d := l2.Reserve()
+	c.Assert(d, check.Equals, time.Millisecond*150+1)
+	clock.Advance(d - 1)
+	c.Assert(l1.Remains(), check.Equals, 0)
+	clock.Advance(1)
+	c.Assert(l1.Reserve(), check.Equals, time.Duration(0))
+	c.Assert(l1.Remains(), check.Equals, 3)
+	c.Assert(l2.Take(), check.IsNil)
+	c.Assert(l1.Taken(), check.Equals, 3)
+
+	// all outdated, the keys are removed
+	clock.Advance(time.Millisecond*200 + 1)
+	c.Assert(l1.Remains(), check.Equals, 5)
+	c.Assert(other.Remains(), check.Equals, 5)
+	c.Assert(store.(*memoryStore).events, check.HasLen, 0)
+}
+
+func (s *rateSuit) TestDistLimiterRedis(c *check.C) {
+	clock := newFakeClock()
+	srv := newFakeRedis(c, "secret", clock)
+	defer srv.Close()
+
+	// two stores stand for two processes
+	opts := &RedisOptions{Addr: srv.Addr(), Password: "secret", DB: 1}
+	s1, s2 := NewRedisStore(opts), NewRedisStore(opts)
+	defer s1.Close()
+	defer s2.Close()
+
+	l1 := NewDistLimiter(s1, "api", time.Millisecond*300, 5, nil)
+	l2 := NewDistLimiter(s2, "api", time.Millisecond*300, 5, nil)
+
+	c.Assert(l1.TakeN(3), check.IsNil)
+	clock.Advance(time.Millisecond * 50)
+	c.Assert(l2.TakeN(3), check.Equals, ErrNoMoreTokens)
+	c.Assert(l2.TakeN(2), check.IsNil)
+	c.Assert(l1.Take(), check.Equals, ErrNoMoreTokens)
+	c.Assert(l1.Taken(), check.Equals, 5)
+	c.Assert(l2.Remains(), check.Equals, 0)
+	c.Assert(srv.Card("rate:api"), check.Equals, 5)
+
+	// the script is loaded on the server once
+	c.Assert(srv.Loads(), check.Equals, 1)
+
+	// the 3 events of the first batch are outdated just after the window, timed in microseconds
+	d := l2.Reserve()
+	c.Assert(d, check.Equals, time.Millisecond*250+time.Microsecond)
+	clock.Advance(d - time.Microsecond)
+	c.Assert(l1.Remains(), check.Equals, 0)
+	clock.Advance(time.Microsecond)
+	c.Assert(l1.Reserve(), check.Equals, time.Duration(0))
+	c.Assert(l1.Remains(), check.Equals, 3)
+	c.Assert(l2.Take(), check.IsNil)
+	c.Assert(l1.Taken(), check.Equals, 3)
+
+	// the outdated events are removed on the next take
+	c.Assert(srv.Card("rate:api"), check.Equals, 3)
+}
+
+func (s *rateSuit) TestDistLimiterRedisConcurrently(c *check.C) {
+	srv := newFakeRedis(c, "", newFakeClock())
+	defer srv.Close()
+
+	var (
+		wg    sync.WaitGroup
+		taken int64
+		errs  int64
+		limit = 50
+		opts  = &DistOptions{OnError: func(error) { atomic.AddInt64(&errs, 1) }}
+	)
+	for i := 0; i < 20; i++ {
+		store := NewRedisStore(&RedisOptions{Addr: srv.Addr()})
+		defer store.Close()
+
+		l := NewDistLimiter(store, "concurrent", time.Minute, limit, opts)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 10; j++ {
+				if l.Take() == nil {
+					atomic.AddInt64(&taken, 1)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	// never exceed the limit across the stores, and never fail on the contention
+	c.Assert(int(taken), check.Equals, limit)
+	c.Assert(atomic.LoadInt64(&errs), check.Equals, int64(0))
+	c.Assert(srv.Card("rate:concurrent"), check.Equals, limit)
+}
+
+func (s *rateSuit) TestDistLimiterStoreError(c *check.C) {
+	srv := newFakeRedis(c, "secret", newFakeClock())
+	defer srv.Close()
+
+	var errs int64
+	onError := func(error) { atomic.AddInt64(&errs, 1) }
+
+	// rejected on errors by default
+	store := NewRedisStore(&RedisOptions{Addr: srv.Addr(), Password: "wrong"})
+	l := NewDistLimiter(store, "api", time.Second, 5, &DistOptions{OnError: onError})
+	c.Assert(l.Take(), check.Equals, ErrNoMoreTokens)
+	c.Assert(l.Remains(), check.Equals, 0)
+	c.Assert(atomic.LoadInt64(&errs), check.Equals, int64(2))
+
+	// allowed on errors if fail open
+	l = NewDistLimiter(store, "api", time.Second, 5, &DistOptions{OnError: onError, FailOpen: true})
+	c.Assert(l.Take(), check.IsNil)
+	c.Assert(l.Remains(), check.Equals, 5)
+	c.Assert(l.Reserve(), check.Equals, time.Duration(0))
+	c.Assert(atomic.LoadInt64(&errs), check.Equals, int64(5))
+}
+
+func (s *rateSuit) TestRedisStoreErrorReply(c *check.C) {
+	srv := newFakeRedis(c, "", newFakeClock())
+	defer srv.Close()
+
+	store := NewRedisStore(&RedisOptions{Addr: srv.Addr()})
+	defer store.Close()
+
+	_, ok, err := store.Take("api", time.Second, 1, 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(ok, check.Equals, true)
+
+	// the error replies are returned, and the connection is kept
+	srv.Fail("ZRANGEBYSCORE", "ERR injected")
+	_, err = store.Reserve("api", time.Second, 1)
+	c.Assert(err, check.ErrorMatches, "redis: ERR injected")
+	srv.Fail("EVALSHA", "WRONGTYPE Operation against a key holding the wrong kind of value")
+	_, _, err = store.Take("api", time.Second, 1, 1)
+	c.Assert(err, check.ErrorMatches, "redis: WRONGTYPE .*")
+	c.Assert(srv.Conns(), check.Equals, 1)
+
+	srv.Fail("ZRANGEBYSCORE", "")
+	d, err := store.Reserve("api", time.Second, 1)
+	c.Assert(err, check.IsNil)
+	c.Assert(d > 0, check.Equals, true)
+	c.Assert(srv.Conns(), check.Equals, 1)
+}
+
+//
+// fake redis server, supports the commands used by the RedisStore
+//
+
+type fakeRedis struct {
+	ln       net.Listener
+	password string
+	clock    *fakeClock
+
+	sync.Mutex                               // protect followings, as redis runs the commands one by one
+	zsets      map[string]map[string]float64 // the sorted sets
+	scripts    map[string]bool               // the sha1 of the loaded scripts
+	loads      int                           // nb of the scripts loaded by EVAL
+	conns      int                           // nb of the connections accepted
+	fails      map[string]string             // the error replies of the commands
+}
+
+// fakeSession is the state of each connection
+type fakeSession struct {
+	authed bool
+}
+
+type fakeStatus string
+
+type fakeError string
+
+func newFakeRedis(c *check.C, password string, clock *fakeClock) *fakeRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	c.Assert(err, check.IsNil)
+
+	srv := &fakeRedis{
+		ln:       ln,
+		password: password,
+		clock:    clock,
+		zsets:    make(map[string]map[string]float64),
+		scripts:  make(map[string]bool),
+		fails:    make(map[string]string),
+	}
+	go srv.serve()
+	return srv
+}
+
+func (srv *fakeRedis) Addr() string {
+	return srv.ln.Addr().String()
+}
+
+func (srv *fakeRedis) Close() error {
+	return srv.ln.Close()
+}
+
+// Card return the nb of members of the sorted set
+func (srv *fakeRedis) Card(key string) int {
+	srv.Lock()
+	defer srv.Unlock()
+	return len(srv.zsets[key])
+}
+
+// Loads return the nb of the scripts loaded by EVAL
+func (srv *fakeRedis) Loads() int {
+	srv.Lock()
+	defer srv.Unlock()
+	return srv.loads
+}
+
+// Conns return the nb of the connections accepted
+func (srv *fakeRedis) Conns() int {
+	srv.Lock()
+	defer srv.Unlock()
+	return srv.conns
+}
+
+// Fail make the command reply the error, empty msg to recover
+func (srv *fakeRedis) Fail(cmd, msg string) {
+	srv.Lock()
+	defer srv.Unlock()
+	srv.fails[cmd] = msg
+}
+
+func (srv *fakeRedis) serve() {
+	for {
+		conn, err := srv.ln.Accept()
+		if err != nil {
+			return
+		}
+		srv.Lock()
+		srv.conns++
+		srv.Unlock()
+		go srv.handle(conn)
+	}
+}
+
+func (srv *fakeRedis) handle(conn net.Conn) {
+	defer conn.Close()
+
+	var (
+		r    = bufio.NewReader(conn)
+		w    = bufio.NewWriter(conn)
+		sess = &fakeSession{authed: srv.password == ""}
+	)
+	for {
+		cmd, err := readFakeCommand(r)
+		if err != nil {
+			return
+		}
+		writeFakeReply(w, srv.process(sess, cmd))
+		if r.Buffered() == 0 { // flush after the pipelined commands
+			w.Flush()
+		}
+	}
+}
+
+func (srv *fakeRedis) process(sess *fakeSession, cmd []string) interface{} {
+	if strings.ToUpper(cmd[0]) == "AUTH" {
+		if len(cmd) != 2 || cmd[1] != srv.password {
+			return fakeError("WRONGPASS invalid password")
+		}
+		sess.authed = true
+		return fakeStatus("OK")
+	}
+	if !sess.authed {
+		return fakeError("NOAUTH Authentication required.")
+	}
+
+	srv.Lock()
+	defer srv.Unlock()
+	if msg := srv.fails[strings.ToUpper(cmd[0])]; msg != "" {
+		return fakeError(msg)
+	}
+	return srv.exec(cmd)
+}
+
+// exec run the data commands, must be called under lock
+func (srv *fakeRedis) exec(cmd []string) interface{} {
+	switch strings.ToUpper(cmd[0]) {
+	case "PING":
+		return fakeStatus("PONG")
+	case "SELECT":
+		return fakeStatus("OK")
+	case "TIME":
+		now := srv.clock.Now().UnixNano() / 1e3
+		return []interface{}{strconv.FormatInt(now/1e6, 10), strconv.FormatInt(now%1e6, 10)}
+	case "EVALSHA":
+		if !srv.scripts[cmd[1]] {
+			return fakeError("NOSCRIPT No matching script. Please use EVAL.")
+		}
+		return srv.take(cmd[3], cmd[4:])
+	case "EVAL":
+		// note: only the take script of the RedisStore is supported
+		if cmd[1] != redisTakeScript {
+			return fakeError("ERR unknown script")
+		}
+		sum := sha1.Sum([]byte(cmd[1]))
+		srv.scripts[hex.EncodeToString(sum[:])] = true
+		srv.loads++
+		return srv.take(cmd[3], cmd[4:])
+	case "PEXPIRE": // expiry not simulated
+		return int64(1)
+	case "ZCARD":
+		return int64(len(srv.zsets[cmd[1]]))
+	case "ZADD":
+		zset, ok := srv.zsets[cmd[1]]
+		if !ok {
+			zset = make(map[string]float64)
+			srv.zsets[cmd[1]] = zset
+		}
+		var added int64
+		for i := 2; i+1 < len(cmd); i += 2 {
+			score, err := strconv.ParseFloat(cmd[i], 64)
+			if err != nil {
+				return fakeError("ERR value is not a valid float")
+			}
+			if _, ok := zset[cmd[i+1]]; !ok {
+				added++
+			}
+			zset[cmd[i+1]] = score
+		}
+		return added
+	case "ZCOUNT":
+		return int64(len(srv.zrange(cmd[1], cmd[2], cmd[3])))
+	case "ZREMRANGEBYSCORE":
+		members := srv.zrange(cmd[1], cmd[2], cmd[3])
+		for _, m := range members {
+			delete(srv.zsets[cmd[1]], m)
+		}
+		return int64(len(members))
+	case "ZRANGEBYSCORE":
+		members := srv.zrange(cmd[1], cmd[2], cmd[3])
+		var withScores bool
+		for i := 4; i < len(cmd); i++ {
+			switch strings.ToUpper(cmd[i]) {
+			case "WITHSCORES":
+				withScores = true
+			case "LIMIT":
+				offset, _ := strconv.Atoi(cmd[i+1])
+				count, _ := strconv.Atoi(cmd[i+2])
+				i += 2
+				if offset > len(members) {
+					offset = len(members)
+				}
+				members = members[offset:]
+				if count >= 0 && count < len(members) {
+					members = members[:count]
+				}
+			}
+		}
+		reply := make([]interface{}, 0, len(members)*2)
+		for _, m := range members {
+			reply = append(reply, m)
+			if withScores {
+				reply = append(reply, strconv.FormatFloat(srv.zsets[cmd[1]][m], 'f', -1, 64))
+			}
+		}
+		return reply
+	}
+	return fakeError(fmt.Sprintf("ERR unknown command '%s'", cmd[0]))
+}
+
+// take run the take script by the same commands step by step, must be called under lock
+func (srv *fakeRedis) take(key string, argv []string) interface{} {
+	var (
+		t         = srv.exec([]string{"TIME"}).([]interface{})
+		sec, _    = strconv.ParseInt(t[0].(string), 10, 64)
+		usec, _   = strconv.ParseInt(t[1].(string), 10, 64)
+		now       = sec*1e6 + usec
+		window, _ = strconv.ParseInt(argv[0], 10, 64)
+		limit, _  = strconv.ParseInt(argv[1], 10, 64)
+		n, _      = strconv.ParseInt(argv[2], 10, 64)
+	)
+	srv.exec([]string{"ZREMRANGEBYSCORE", key, "-inf", "(" + strconv.FormatInt(now-window, 10)})
+	count := srv.exec([]string{"ZCARD", key}).(int64)
+	if count+n > limit {
+		return []interface{}{count, int64(0)}
+	}
+	score := strconv.FormatInt(now, 10)
+	for i := int64(1); i <= n; i++ {
+		srv.exec([]string{"ZADD", key, score, score + "-" + argv[3] + "-" + strconv.FormatInt(i, 10)})
+	}
+	srv.exec([]string{"PEXPIRE", key, argv[4]})
+	return []interface{}{count + n, int64(1)}
+}
+
+// zrange return the members in the score range, ordered by score
+func (srv *fakeRedis) zrange(key, min, max string) []string {
+	var (
+		zset              = srv.zsets[key]
+		minScore, minExcl = parseFakeBound(min)
+		maxScore, maxExcl = parseFakeBound(max)
+		members           = make([]string, 0, len(zset))
+	)
+	for m, score := range zset {
+		if score < minScore || minExcl && score == minScore {
+			continue
+		}
+		if score > maxScore || maxExcl && score == maxScore {
+			continue
+		}
+		members = append(members, m)
+	}
+	sort.Slice(members, func(i, j int) bool {
+		si, sj := zset[members[i]], zset[members[j]]
+		return si < sj || si == sj && members[i] < members[j]
+	})
+	return members
+}
+
+// parseFakeBound parse the score bound, eg: -inf, +inf, 10, (10
+func parseFakeBound(bound string) (float64, bool) {
+	exclusive := strings.HasPrefix(bound, "(")
+	v, _ := strconv.ParseFloat(strings.TrimPrefix(bound, "("), 64)
+	return v, exclusive
+}
+
+func readFakeCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("invalid command %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+
+	cmd := make([]string, 0, n)
+	for i := 0; i < n; i++ {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		size, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+		if err != nil {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(r, buf); err != nil {
+			return nil, err
+		}
+		cmd = append(cmd, string(buf[:size]))
+	}
+	return cmd, nil
+}
+
+func writeFakeReply(w *bufio.Writer, reply interface{}) {
+	switch v := reply.(type) {
+	case fakeStatus:
+		fmt.Fprintf(w, "+%s\r\n", v)
+	case fakeError:
+		fmt.Fprintf(w, "-%s\r\n", v)
+	case int64:
+		fmt.Fprintf(w, ":%d\r\n", v)
+	case string:
+		fmt.Fprintf(w, "$%d\r\n%s\r\n", len(v), v)
+	case []interface{}:
+		fmt.Fprintf(w, "*%d\r\n", len(v))
+		for _, item := range v {
+			writeFakeReply(w, item)
+		}
+	case nil:
+		fmt.Fprintf(w, "$-1\r\n")
+	}
+}
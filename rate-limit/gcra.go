@@ -0,0 +1,160 @@
+package rate
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// NewGCRA new a generic cell rate algorithm limiter, it's equivalent to the
+// token bucket but only tracks the theoretical arrival time (TAT) of the next
+// event: each event pushes the TAT forward by the emission interval w/n, and
+// the event is rejected if the TAT would exceed now + w, so it allows bursts
+// of n events and a sustained rate of n events in w, with O(1) memory.
+func NewGCRA(w time.Duration, n int) Limiter {
+	l := &gcra{}
+	l.SetLimit(w, n)
+	return l
+}
+
+type gcra struct {
+	sync.Mutex               // protect followings
+	window     time.Duration // token time window, the burst tolerance
+	limit      int           // token limit
+	interval   time.Duration // emission interval: window / limit
+	tat        time.Time     // theoretical arrival time
+}
+
+// Take implement Limiter interface
+func (l *gcra) Take() error {
+	return l.TakeN(1)
+}
+
+// TakeN implement Limiter interface
+func (l *gcra) TakeN(n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	l.Lock()
+	defer l.Unlock()
+
+	if n > l.limit {
+		return ErrNoMoreTokens
+	}
+
+	now := time.Now()
+	next := l.arrival(now).Add(l.interval * time.Duration(n))
+	if next.Sub(now) > l.window {
+		return ErrNoMoreTokens
+	}
+
+	l.tat = next
+	return nil
+}
+
+// Wait implement Limiter interface
+func (l *gcra) Wait(ctx context.Context) error {
+	return wait(ctx, l)
+}
+
+// Reserve implement Limiter interface
+func (l *gcra) Reserve() time.Duration {
+	l.Lock()
+	defer l.Unlock()
+
+	if l.limit == 0 {
+		return never
+	}
+
+	now := time.Now()
+	d := l.arrival(now).Add(l.interval).Sub(now) - l.window
+	if d < 0 {
+		d = 0
+	}
+	return d
+}
+
+// Remains implement Limiter interface
+func (l *gcra) Remains() int {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.remains(time.Now())
+}
+
+// Taken implement Limiter interface, the nb of tokens
+// taken but not regained yet
+func (l *gcra) Taken() int {
+	l.Lock()
+	defer l.Unlock()
+
+	return l.limit - l.remains(time.Now())
+}
+
+// SetLimit implement Limiter interface, the tokens taken
+// but not regained yet are kept under the new limit
+func (l *gcra) SetLimit(w time.Duration, n int) {
+	l.Lock()
+	defer l.Unlock()
+
+	if w < 0 {
+		w = -w
+	}
+	if n < 0 {
+		n = -n
+	}
+
+	now := time.Now()
+	taken := l.limit - l.remains(now)
+
+	l.window = w
+	l.limit = n
+	l.interval = 0
+	if n > 0 {
+		l.interval = w / time.Duration(n)
+	}
+	l.tat = now.Add(l.interval * time.Duration(taken))
+}
+
+// String implement Limiter interface
+func (l *gcra) String() string {
+	l.Lock()
+	defer l.Unlock()
+
+	return fmt.Sprintf("gcra limit %d tokens in %s, current remains %d", l.limit, l.window.String(), l.remains(time.Now()))
+}
+
+//
+// unsafe ops
+//
+
+// arrival return the TAT, or now if the TAT has passed
+func (l *gcra) arrival(now time.Time) time.Time {
+	if l.tat.Before(now) {
+		return now
+	}
+	return l.tat
+}
+
+// remains calculate the nb of events allowed before the TAT exceeds now + window
+func (l *gcra) remains(now time.Time) int {
+	if l.interval <= 0 {
+		return l.limit
+	}
+
+	var used time.Duration // the debt ahead of now
+	if l.tat.After(now) {
+		used = l.tat.Sub(now)
+	}
+
+	n := int((l.window - used) / l.interval)
+	if n < 0 {
+		n = 0
+	}
+	if n > l.limit {
+		n = l.limit
+	}
+	return n
+}
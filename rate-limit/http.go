@@ -0,0 +1,117 @@
+package rate
+
+import (
+	"math"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// HTTPLimiter limits the http requests by the limiter of each request's key,
+// eg: the client ip, api key or route, and sets the standard rate limit headers:
+//
+//	RateLimit-Limit:     the limit of the key in the window
+//	RateLimit-Remaining: the remains of the key
+//	RateLimit-Reset:     seconds until the next token if no remains, otherwise the window
+//	Retry-After:         seconds until the next token, only on the rejected requests
+//
+// see https://datatracker.ietf.org/doc/draft-ietf-httpapi-ratelimit-headers/
+type HTTPLimiter struct {
+	k     *KeyedLimiter
+	keyFn func(*http.Request) string
+}
+
+// NewHTTPLimiter new a http limiter by the keyed limiter, the requests are keyed
+// by the keyFn, default KeyByIP. use a constant key for a global limit.
+func NewHTTPLimiter(k *KeyedLimiter, keyFn func(*http.Request) string) *HTTPLimiter {
+	if keyFn == nil {
+		keyFn = KeyByIP
+	}
+	return &HTTPLimiter{k: k, keyFn: keyFn}
+}
+
+// Allow take a token for the request and set the rate limit headers on w,
+// return false if the request is over the limit, the caller should reject
+// it with 429, the Retry-After header has been set.
+func (h *HTTPLimiter) Allow(w http.ResponseWriter, r *http.Request) bool {
+	var (
+		window, limit = h.k.Limit()
+		l             = h.k.Get(h.keyFn(r))
+		err           = l.Take()
+		remains       = l.Remains()
+		header        = w.Header()
+	)
+
+	reset := window
+	if remains == 0 {
+		if reset = l.Reserve(); reset > window {
+			reset = window
+		}
+	}
+
+	header.Set("RateLimit-Limit", strconv.Itoa(limit))
+	header.Set("RateLimit-Remaining", strconv.Itoa(remains))
+	header.Set("RateLimit-Reset", strconv.Itoa(seconds(reset)))
+
+	if err != nil {
+		retry := seconds(reset)
+		if retry < 1 {
+			retry = 1
+		}
+		header.Set("Retry-After", strconv.Itoa(retry))
+		return false
+	}
+	return true
+}
+
+// Handler wrap the http handler, the over-limit requests are rejected with 429
+func (h *HTTPLimiter) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !h.Allow(w, r) {
+			http.Error(w, ErrNoMoreTokens.Error(), http.StatusTooManyRequests)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// KeyByIP key the requests by the remote ip
+//
+// note: the X-Forwarded-For & X-Real-IP headers are ignored as they could be
+// forged, use KeyByHeader if behind a trusted proxy.
+func KeyByIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
+
+// KeyByHeader key the requests by the header, eg: X-API-Key, X-Real-IP,
+// the requests without the header are keyed by KeyByIP, so they don't
+// share the same empty key.
+func KeyByHeader(name string) func(*http.Request) string {
+	return KeyByHeaderOr(name, KeyByIP)
+}
+
+// KeyByHeaderOr key the requests by the header, the requests without
+// the header are keyed by the fallback
+func KeyByHeaderOr(name string, fallback func(*http.Request) string) func(*http.Request) string {
+	return func(r *http.Request) string {
+		if key := r.Header.Get(name); key != "" {
+			return key
+		}
+		return fallback(r)
+	}
+}
+
+// KeyByRoute key the requests by the method & path
+func KeyByRoute(r *http.Request) string {
+	return r.Method + " " + r.URL.Path
+}
+
+// seconds round up the duration to seconds
+func seconds(d time.Duration) int {
+	return int(math.Ceil(d.Seconds()))
+}
@@ -0,0 +1,88 @@
+package rate
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+func (s *rateSuit) TestHTTPLimiter(c *check.C) {
+	var (
+		k = NewKeyedLimiter(time.Minute, 2, &KeyedOptions{New: NewLimiter})
+		h = NewHTTPLimiter(k, KeyByHeader("X-API-Key")).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+	)
+
+	do := func(key string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.Header.Set("X-API-Key", key)
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w
+	}
+
+	// within the limit
+	for i := 1; i <= 2; i++ {
+		w := do("a")
+		c.Assert(w.Code, check.Equals, http.StatusOK)
+		c.Assert(w.Header().Get("RateLimit-Limit"), check.Equals, "2")
+		c.Assert(w.Header().Get("RateLimit-Remaining"), check.Equals, strconv.Itoa(2-i))
+		c.Assert(w.Header().Get("Retry-After"), check.Equals, "")
+	}
+
+	// over the limit
+	w := do("a")
+	c.Assert(w.Code, check.Equals, http.StatusTooManyRequests)
+	c.Assert(w.Header().Get("RateLimit-Remaining"), check.Equals, "0")
+	reset, _ := strconv.Atoi(w.Header().Get("RateLimit-Reset"))
+	retry, _ := strconv.Atoi(w.Header().Get("Retry-After"))
+	c.Assert(reset > 0 && reset <= 60, check.Equals, true, check.Commentf("reset %d", reset))
+	c.Assert(retry, check.Equals, reset)
+
+	// the other key is limited separately
+	w = do("b")
+	c.Assert(w.Code, check.Equals, http.StatusOK)
+	c.Assert(w.Header().Get("RateLimit-Remaining"), check.Equals, "1")
+	c.Assert(w.Header().Get("RateLimit-Reset"), check.Equals, "60")
+}
+
+func (s *rateSuit) TestHTTPKeys(c *check.C) {
+	req := httptest.NewRequest("POST", "/v1/users?id=1", nil)
+	req.RemoteAddr = "10.0.0.1:12345"
+	req.Header.Set("X-Real-IP", "1.2.3.4")
+
+	c.Assert(KeyByIP(req), check.Equals, "10.0.0.1")
+	c.Assert(KeyByHeader("X-Real-IP")(req), check.Equals, "1.2.3.4")
+	c.Assert(KeyByRoute(req), check.Equals, "POST /v1/users")
+
+	// the requests without the header fall back
+	c.Assert(KeyByHeader("X-API-Key")(req), check.Equals, "10.0.0.1")
+	c.Assert(KeyByHeaderOr("X-API-Key", KeyByRoute)(req), check.Equals, "POST /v1/users")
+	c.Assert(KeyByHeaderOr("X-Real-IP", KeyByRoute)(req), check.Equals, "1.2.3.4")
+}
+
+func (s *rateSuit) TestHTTPLimiterWithoutHeader(c *check.C) {
+	var (
+		k = NewKeyedLimiter(time.Minute, 1, &KeyedOptions{New: NewLimiter})
+		h = NewHTTPLimiter(k, KeyByHeader("X-API-Key")).Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Write([]byte("ok"))
+		}))
+	)
+
+	do := func(ip string) int {
+		req := httptest.NewRequest("GET", "/", nil)
+		req.RemoteAddr = ip + ":12345"
+		w := httptest.NewRecorder()
+		h.ServeHTTP(w, req)
+		return w.Code
+	}
+
+	// the clients without the key don't share the same limit
+	c.Assert(do("10.0.0.1"), check.Equals, http.StatusOK)
+	c.Assert(do("10.0.0.2"), check.Equals, http.StatusOK)
+	c.Assert(do("10.0.0.1"), check.Equals, http.StatusTooManyRequests)
+}
@@ -1,7 +1,9 @@
 package rate
 
 import (
+	"context"
 	"errors"
+	"math"
 	"time"
 )
 
@@ -14,6 +16,12 @@ var (
 type Limiter interface {
 	Take() error // Take take one token, if met error, must be ErrNoMoreTokens
 
+	TakeN(n int) error // TakeN take n tokens at once or none of them, if met error, must be ErrNoMoreTokens
+
+	Wait(ctx context.Context) error // Wait block until took one token, or return the ctx.Err() once the ctx is done
+
+	Reserve() time.Duration // how long to wait until the next token available, 0 means available now, it doesn't take the token
+
 	Remains() int // how many tokens remains, always used to check if reached limit line
 
 	Taken() int // how many tokens has been taken
@@ -22,3 +30,49 @@ type Limiter interface {
 
 	String() string // print limiter text message
 }
+
+// ConcurrencyLimiter caps the in-flight work, the limit is adjusted
+// adaptively by the latency & errors of the finished work
+type ConcurrencyLimiter interface {
+	Acquire() error // Acquire take a slot for a work, if met error, must be ErrNoMoreTokens
+
+	Release(latency time.Duration, err error) // Release release the slot with the latency & error of the finished work
+
+	Limit() int // current limit of the in-flight work
+
+	InFlight() int // nb of the in-flight work
+
+	String() string // print limiter text message
+}
+
+// the Reserve result of the zero limit, the token is never available
+const never = time.Duration(math.MaxInt64)
+
+var (
+	// the max interval Wait checks the limiter again, so the limit changed
+	// by SetLimit on the fly could be noticed during a long wait
+	maxWaitInterval = time.Second
+)
+
+// wait implement the Wait of Limiter by Take & Reserve
+func wait(ctx context.Context, l Limiter) error {
+	for {
+		err := l.Take()
+		if err != ErrNoMoreTokens {
+			return err
+		}
+
+		d := l.Reserve()
+		if d > maxWaitInterval {
+			d = maxWaitInterval
+		}
+
+		timer := time.NewTimer(d)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
@@ -0,0 +1,200 @@
+package rate
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// KeyedOptions is the optional settings of the KeyedLimiter
+type KeyedOptions struct {
+	// New is the constructor of the limiter of each key, default NewTokenBucket
+	New func(w time.Duration, n int) Limiter
+	// TTL is the idle time to evict the limiter of a key, default & min: the window,
+	// so the evicted limiters have regained all of the tokens already.
+	TTL time.Duration
+}
+
+// KeyUsage is the current usage of a key
+type KeyUsage struct {
+	Key      string    `json:"key"`
+	Taken    int       `json:"taken"`
+	Remains  int       `json:"remains"`
+	LastSeen time.Time `json:"last_seen"`
+}
+
+// KeyedLimiter holds a separated limiter for each key, eg: the api key or client ip,
+// the limiters are created lazily on the first use of the key, and evicted after
+// idle for the TTL to bound the memory.
+//
+// note: the idle keys are swept lazily on the accesses, at most once per half TTL.
+type KeyedLimiter struct {
+	newFn func(time.Duration, int) Limiter
+	ttl   time.Duration
+
+	sync.Mutex                        // protect followings
+	window     time.Duration          // token time window of each key
+	limit      int                    // token limit of each key
+	entries    map[string]*keyedEntry // limiter of each key
+	swept      time.Time              // the time of last sweep
+}
+
+type keyedEntry struct {
+	l    Limiter
+	seen time.Time // the time of last access
+}
+
+// NewKeyedLimiter new a keyed limiter, each key is limited to n events in w
+func NewKeyedLimiter(w time.Duration, n int, opts *KeyedOptions) *KeyedLimiter {
+	o := KeyedOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.New == nil {
+		o.New = NewTokenBucket
+	}
+
+	k := &KeyedLimiter{
+		newFn:   o.New,
+		ttl:     o.TTL,
+		entries: make(map[string]*keyedEntry),
+		swept:   time.Now(),
+	}
+	k.SetLimit(w, n)
+	return k
+}
+
+// Get return the limiter of the key, create it if not exists
+func (k *KeyedLimiter) Get(key string) Limiter {
+	k.Lock()
+	defer k.Unlock()
+
+	now := time.Now()
+	k.sweep(now)
+
+	e, ok := k.entries[key]
+	if !ok {
+		e = &keyedEntry{l: k.newFn(k.window, k.limit)}
+		k.entries[key] = e
+	}
+	e.seen = now
+	return e.l
+}
+
+// Take take one token of the key
+func (k *KeyedLimiter) Take(key string) error {
+	return k.Get(key).Take()
+}
+
+// TakeN take n tokens of the key at once or none of them
+func (k *KeyedLimiter) TakeN(key string, n int) error {
+	return k.Get(key).TakeN(n)
+}
+
+// Wait block until took one token of the key, or the ctx is done
+func (k *KeyedLimiter) Wait(ctx context.Context, key string) error {
+	return k.Get(key).Wait(ctx)
+}
+
+// Reserve return how long to wait until the next token of the key available
+func (k *KeyedLimiter) Reserve(key string) time.Duration {
+	return k.Get(key).Reserve()
+}
+
+// Remove remove the limiter of the key, the key starts over on next use
+func (k *KeyedLimiter) Remove(key string) {
+	k.Lock()
+	delete(k.entries, key)
+	k.Unlock()
+}
+
+// Len return the nb of keys currently tracked
+func (k *KeyedLimiter) Len() int {
+	k.Lock()
+	defer k.Unlock()
+
+	k.sweep(time.Now())
+	return len(k.entries)
+}
+
+// Limit return the limit settings of each key
+func (k *KeyedLimiter) Limit() (time.Duration, int) {
+	k.Lock()
+	defer k.Unlock()
+	return k.window, k.limit
+}
+
+// SetLimit change the limit settings of all keys on fly
+func (k *KeyedLimiter) SetLimit(w time.Duration, n int) {
+	if w < 0 {
+		w = -w
+	}
+	if n < 0 {
+		n = -n
+	}
+
+	k.Lock()
+	defer k.Unlock()
+
+	k.window = w
+	k.limit = n
+	for _, e := range k.entries {
+		e.l.SetLimit(w, n)
+	}
+}
+
+// Usage return the current usage of each key, sorted by key
+func (k *KeyedLimiter) Usage() []KeyUsage {
+	k.Lock()
+	k.sweep(time.Now())
+	usages := make([]KeyUsage, 0, len(k.entries))
+	limiters := make([]Limiter, 0, len(k.entries))
+	for key, e := range k.entries {
+		usages = append(usages, KeyUsage{Key: key, LastSeen: e.seen})
+		limiters = append(limiters, e.l)
+	}
+	k.Unlock()
+
+	// query the limiters out of the lock
+	for i, l := range limiters {
+		usages[i].Taken, usages[i].Remains = l.Taken(), l.Remains()
+	}
+
+	sort.Slice(usages, func(i, j int) bool { return usages[i].Key < usages[j].Key })
+	return usages
+}
+
+// String return the keyed limiter text message
+func (k *KeyedLimiter) String() string {
+	w, n := k.Limit()
+	return fmt.Sprintf("limit %d tokens in %s per key, current keys %d", n, w.String(), k.Len())
+}
+
+//
+// unsafe ops
+//
+
+// idle return the idle time to evict a key, no less than the window
+func (k *KeyedLimiter) idle() time.Duration {
+	if k.ttl < k.window {
+		return k.window
+	}
+	return k.ttl
+}
+
+// sweep evict the idle keys, at most once per half TTL
+func (k *KeyedLimiter) sweep(now time.Time) {
+	ttl := k.idle()
+	if now.Sub(k.swept) < ttl/2 {
+		return
+	}
+	k.swept = now
+
+	for key, e := range k.entries {
+		if now.Sub(e.seen) >= ttl {
+			delete(k.entries, key)
+		}
+	}
+}
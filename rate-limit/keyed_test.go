@@ -0,0 +1,70 @@
+package rate
+
+import (
+	"time"
+
+	check "gopkg.in/check.v1"
+)
+
+func (s *rateSuit) TestKeyed(c *check.C) {
+	k := NewKeyedLimiter(time.Second, 3, nil)
+	c.Assert(k, check.NotNil)
+
+	// each key has its own limit
+	for i := 1; i <= 3; i++ {
+		c.Assert(k.Take("a"), check.IsNil)
+	}
+	c.Assert(k.Take("a"), check.Equals, ErrNoMoreTokens)
+	c.Assert(k.Take("b"), check.IsNil)
+	c.Assert(k.TakeN("c", 4), check.Equals, ErrNoMoreTokens)
+	c.Assert(k.Len(), check.Equals, 3)
+	c.Assert(k.Reserve("a") > 0, check.Equals, true)
+	c.Assert(k.Reserve("b"), check.Equals, time.Duration(0))
+
+	// the usage of each key
+	usages := k.Usage()
+	c.Assert(usages, check.HasLen, 3)
+	c.Assert(usages[0].Key, check.Equals, "a")
+	c.Assert(usages[0].Taken, check.Equals, 3)
+	c.Assert(usages[0].Remains, check.Equals, 0)
+	c.Assert(usages[1].Key, check.Equals, "b")
+	c.Assert(usages[1].Taken, check.Equals, 1)
+	c.Assert(usages[2].Key, check.Equals, "c")
+	c.Assert(usages[2].Taken, check.Equals, 0)
+
+	// change the limit of all keys
+	k.SetLimit(time.Second, 5)
+	w, n := k.Limit()
+	c.Assert(w, check.Equals, time.Second)
+	c.Assert(n, check.Equals, 5)
+	c.Assert(k.Get("a").Remains(), check.Equals, 2)
+	c.Assert(k.Get("new").Remains(), check.Equals, 5)
+
+	// remove a key, starts over
+	k.Remove("a")
+	c.Assert(k.Get("a").Remains(), check.Equals, 5)
+	c.Assert(k.String(), check.Equals, "limit 5 tokens in 1s per key, current keys 4")
+}
+
+func (s *rateSuit) TestKeyedEviction(c *check.C) {
+	k := NewKeyedLimiter(time.Millisecond*50, 1, &KeyedOptions{
+		New: NewLimiter,
+		TTL: time.Millisecond * 100,
+	})
+
+	c.Assert(k.Take("idle"), check.IsNil)
+	c.Assert(k.Take("busy"), check.IsNil)
+
+	// keep the busy key active
+	for i := 0; i < 6; i++ {
+		time.Sleep(time.Millisecond * 25)
+		k.Get("busy")
+	}
+
+	// the idle key evicted
+	c.Assert(k.Len(), check.Equals, 1)
+	usages := k.Usage()
+	c.Assert(usages, check.HasLen, 1)
+	c.Assert(usages[0].Key, check.Equals, "busy")
+	c.Assert(k.Take("idle"), check.IsNil)
+}
@@ -1,134 +1,290 @@
 package rate
 
 import (
+	"context"
 	"fmt"
 	"sync"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	// the start point of the monotonic clock of the sliding log
+	epoch = time.Now()
+
+	// the max retries of the lock-free reads before falling back to the lock
+	seqlockRetries = 4
+)
+
+// nanotime return the monotonic nanoseconds since the epoch, always > 0
+// so the zero value of a slot means empty
+func nanotime() int64 {
+	return int64(time.Since(epoch)) + 1
+}
+
 // NewLimiter new a event limiter
 func NewLimiter(w time.Duration, n int) Limiter {
 	l := &limiter{}
 	l.SetLimit(w, n)
-	l.tokens = make([]time.Time, 0, 0)
 	return l
 }
 
+// limiter is the sliding log, it keeps the taken time of the latest n tokens in a
+// ring, a token is available once the oldest one in the ring is out of the window.
+//
+// the writers are serialized by the mutex, while the readers and the rejections
+// of Take (the common case under the heavy load) are lock-free: the ring is read
+// under a seqlock, and retried or fall back to the lock if it's being written.
+//
+// note: the ring's slots grow on demand up to the limit, only the tokens in the
+// window take the memory, so a huge limit with a few takes is cheap.
 type limiter struct {
-	sync.RWMutex               // protect followings
-	window       time.Duration // token time window
-	limit        int           // token limit
-	tokens       []time.Time   // tokens already been taken
+	sync.Mutex              // serialize the writers
+	ring       atomic.Value // *tokenRing, replaced by SetLimit & on growing
+}
+
+// tokenRing is the ring of the taken tokens, the window, limit & slots size are
+// immutable. the ring is viewed as limit nb of slots, the slots not allocated
+// yet are the empty ones before the oldest allocated slot.
+type tokenRing struct {
+	window int64   // token time window, nanoseconds
+	limit  int     // token limit
+	slots  []int64 // atomic, taken time of the latest tokens by nanotime, oldest first from head
+	head   uint64  // atomic, index of the oldest slot
+	seq    uint64  // atomic, the seqlock, odd while writing
 }
 
 // Take implement Limiter interface
 func (l *limiter) Take() error {
+	return l.TakeN(1)
+}
+
+// TakeN implement Limiter interface
+func (l *limiter) TakeN(n int) error {
+	if n <= 0 {
+		return nil
+	}
+
+	// fast path: reject without lock if the n-th oldest token is still in the window
+	r := l.load()
+	if n > r.limit {
+		return ErrNoMoreTokens
+	}
+	if ts, ok := r.readNth(n - 1); ok && !r.outdated(ts, nanotime()) {
+		return ErrNoMoreTokens
+	}
+
 	l.Lock()
 	defer l.Unlock()
 
-	l.gc()
-	if l.remains() == 0 {
+	r = l.load() // might be replaced meanwhile
+	if n > r.limit {
+		return ErrNoMoreTokens
+	}
+	now := nanotime()
+	if !r.outdated(r.nth(r.head, n-1), now) {
 		return ErrNoMoreTokens
 	}
 
-	l.push()
+	if grown := r.push(now, n); grown != r {
+		l.ring.Store(grown)
+	}
 	return nil
 }
 
+// Wait implement Limiter interface
+func (l *limiter) Wait(ctx context.Context) error {
+	return wait(ctx, l)
+}
+
+// Reserve implement Limiter interface
+func (l *limiter) Reserve() time.Duration {
+	r := l.load()
+	if r.limit == 0 {
+		return never
+	}
+
+	ts, ok := r.readNth(0)
+	if !ok {
+		l.Lock()
+		ts = r.nth(r.head, 0)
+		l.Unlock()
+	}
+
+	now := nanotime()
+	if r.outdated(ts, now) {
+		return 0
+	}
+	// the oldest token is outdated just after the window
+	return time.Duration(ts + r.window - now + 1)
+}
+
 // Remains implement Limiter interface
 func (l *limiter) Remains() int {
-	l.RLock()
-	defer l.RUnlock()
-
-	l.gc()
-	return l.remains()
+	r := l.load()
+	return r.limit - l.count(r)
 }
 
 // Taken implement Limiter interface
 func (l *limiter) Taken() int {
-	l.RLock()
-	defer l.RUnlock()
-
-	l.gc()
-	return l.size()
+	return l.count(l.load())
 }
 
-// SetLimit implement Limiter interface
+// SetLimit implement Limiter interface, the latest
+// n tokens are kept under the new limit
 func (l *limiter) SetLimit(w time.Duration, n int) {
-	l.Lock()
 	if w < 0 {
 		w = -w
 	}
 	if n < 0 {
 		n = -n
 	}
-	l.window = w
-	l.limit = n
-	l.Unlock()
+
+	l.Lock()
+	defer l.Unlock()
+
+	r := &tokenRing{
+		window: int64(w),
+		limit:  n,
+	}
+
+	// copy the latest tokens to the new ring
+	if old, ok := l.ring.Load().(*tokenRing); ok {
+		k := len(old.slots)
+		if k > n {
+			k = n
+		}
+		r.slots = make([]int64, k)
+		for i := 0; i < k; i++ {
+			r.slots[i] = old.slot(old.head, len(old.slots)-k+i)
+		}
+	}
+
+	l.ring.Store(r)
 }
 
 // String implement Limiter interface
 func (l *limiter) String() string {
-	return fmt.Sprintf("limit %d tokens in %s, current remains %d", l.limit, l.window.String(), l.Remains())
+	r := l.load()
+	return fmt.Sprintf("limit %d tokens in %s, current remains %d", r.limit, time.Duration(r.window).String(), r.limit-l.count(r))
+}
+
+func (l *limiter) load() *tokenRing {
+	return l.ring.Load().(*tokenRing)
+}
+
+// count return the nb of tokens in the window, lock-free unless the ring is busy writing
+func (l *limiter) count(r *tokenRing) int {
+	if n, ok := r.readCount(nanotime()); ok {
+		return n
+	}
+
+	l.Lock()
+	defer l.Unlock()
+	return r.countAt(r.head, nanotime())
 }
 
 //
-// unsafe ops
+// ring ops
 //
-func (l *limiter) size() int {
-	return len(l.tokens)
-}
 
-func (l *limiter) remains() int {
-	return l.limit - l.size()
+// outdated check if the token taken at ts is out of the window
+func (r *tokenRing) outdated(ts, now int64) bool {
+	return ts == 0 || ts < now-r.window
 }
 
-// gc shift all of outdated tokens
-// the returned value means the nb of tokens been GCed
-func (l *limiter) gc() int {
-	if len(l.tokens) == 0 {
+// nth return the taken time of the i-th oldest token of the limit, the
+// slots not allocated yet are empty
+func (r *tokenRing) nth(head uint64, i int) int64 {
+	if i -= r.limit - len(r.slots); i < 0 {
 		return 0
 	}
+	return r.slot(head, i)
+}
 
-	// the outdated time boundary
-	outdated := time.Now().Add(-l.window)
+// slot return the taken time of the i-th oldest allocated slot from the head
+func (r *tokenRing) slot(head uint64, i int) int64 {
+	return atomic.LoadInt64(&r.slots[(head+uint64(i))%uint64(len(r.slots))])
+}
 
-	// range from the head oldest tokens to find out the first non-outdated tokens
-	// the index of it should be the nb of tokens to be GCed
-	var n int
-	for idx, token := range l.tokens {
-		if !token.Before(outdated) {
-			break
+// countAt binary search the oldest token in the window, the tokens are ordered by time
+func (r *tokenRing) countAt(head uint64, now int64) int {
+	lo, hi := 0, r.limit
+	for lo < hi {
+		mid := (lo + hi) / 2
+		if r.outdated(r.nth(head, mid), now) {
+			lo = mid + 1
 		} else {
-			n = idx + 1
+			hi = mid
 		}
 	}
-
-	if n > 0 {
-		l.shiftN(n)
-	}
-
-	return n
+	return r.limit - lo
 }
 
-func (l *limiter) pushN(n int) {
-	for i := 1; i <= n; i++ {
-		l.push()
+// push take n tokens at now, must be called under lock. the oldest n allocated
+// slots are overwritten if they're outdated, otherwise the tokens are pushed to a
+// grown ring, it returns the ring taken the tokens.
+func (r *tokenRing) push(now int64, n int) *tokenRing {
+	if k := len(r.slots); k < n || !r.outdated(r.slot(r.head, n-1), now) {
+		size := k * 2
+		if size < k+n {
+			size = k + n
+		}
+		if size < 8 {
+			size = 8
+		}
+		if size > r.limit {
+			size = r.limit
+		}
+
+		// the allocated slots are moved to the tail, the oldest ones are
+		// overwritten only if capped by the limit, they're outdated then
+		grown := &tokenRing{
+			window: r.window,
+			limit:  r.limit,
+			slots:  make([]int64, size),
+		}
+		for i := 0; i < k; i++ {
+			grown.slots[size-k+i] = r.slot(r.head, len(r.slots)-k+i)
+		}
+		r = grown
 	}
-}
 
-func (l *limiter) push() {
-	l.tokens = append(l.tokens, time.Now())
+	atomic.AddUint64(&r.seq, 1) // odd, writing
+	for i := 0; i < n; i++ {
+		atomic.StoreInt64(&r.slots[(r.head+uint64(i))%uint64(len(r.slots))], now)
+	}
+	atomic.StoreUint64(&r.head, r.head+uint64(n))
+	atomic.AddUint64(&r.seq, 1) // even, done
+	return r
 }
 
-func (l *limiter) shiftN(n int) {
-	if l.size() >= n {
-		l.tokens = l.tokens[n:]
+// readNth is the lock-free nth, it fails if the ring keeps being written
+func (r *tokenRing) readNth(i int) (int64, bool) {
+	for try := 0; try < seqlockRetries; try++ {
+		seq := atomic.LoadUint64(&r.seq)
+		if seq&1 == 1 {
+			continue
+		}
+		ts := r.nth(atomic.LoadUint64(&r.head), i)
+		if atomic.LoadUint64(&r.seq) == seq {
+			return ts, true
+		}
 	}
+	return 0, false
 }
 
-func (l *limiter) shift() {
-	if l.size() >= 1 {
-		l.tokens = l.tokens[1:]
+// readCount is the lock-free countAt, it fails if the ring keeps being written
+func (r *tokenRing) readCount(now int64) (int, bool) {
+	for try := 0; try < seqlockRetries; try++ {
+		seq := atomic.LoadUint64(&r.seq)
+		if seq&1 == 1 {
+			continue
+		}
+		n := r.countAt(atomic.LoadUint64(&r.head), now)
+		if atomic.LoadUint64(&r.seq) == seq {
+			return n, true
+		}
 	}
+	return 0, false
 }
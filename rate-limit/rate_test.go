@@ -1,6 +1,9 @@
 package rate
 
 import (
+	"context"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -75,3 +78,400 @@ func (s *rateSuit) TestOutOfToken(c *check.C) {
 	c.Assert(remain, check.Equals, 10-1)
 
 }
+
+var o1Limiters = map[string]func(time.Duration, int) Limiter{
+	"token bucket": NewTokenBucket,
+	"gcra":         NewGCRA,
+}
+
+func (s *rateSuit) TestO1Limiters(c *check.C) {
+	for name, newFn := range o1Limiters {
+		c.Log(name)
+
+		l := newFn(time.Millisecond*100, 10) // max 10 events in 100ms
+		c.Assert(l, check.NotNil)
+
+		// a new limiter is full, burst ten events
+		c.Assert(l.Remains(), check.Equals, 10)
+		for i := 1; i <= 10; i++ {
+			err := l.Take()
+			c.Assert(err, check.IsNil)
+		}
+
+		// taken 10, remains 0
+		c.Assert(l.Taken(), check.Equals, 10)
+		c.Assert(l.Remains(), check.Equals, 0)
+
+		// try one event now!
+		err := l.Take()
+		c.Assert(err, check.Equals, ErrNoMoreTokens)
+
+		// one token regained every 10ms
+		time.Sleep(time.Millisecond * 25)
+		remain := l.Remains()
+		c.Assert(remain >= 1 && remain < 10, check.Equals, true, check.Commentf("%s remains %d", name, remain))
+		err = l.Take()
+		c.Assert(err, check.IsNil)
+
+		// sleep the whole window, full again
+		time.Sleep(time.Millisecond * 100)
+		c.Assert(l.Taken(), check.Equals, 0)
+		c.Assert(l.Remains(), check.Equals, 10)
+	}
+}
+
+func (s *rateSuit) TestO1LimitersSetLimit(c *check.C) {
+	for name, newFn := range o1Limiters {
+		c.Log(name)
+
+		l := newFn(time.Second, 10)
+		for i := 1; i <= 5; i++ {
+			c.Assert(l.Take(), check.IsNil)
+		}
+
+		// shrink the limit, the taken tokens are kept
+		l.SetLimit(time.Second, 6)
+		c.Assert(l.Remains(), check.Equals, 1)
+		c.Assert(l.Take(), check.IsNil)
+		c.Assert(l.Take(), check.Equals, ErrNoMoreTokens)
+
+		// zero limit rejects all events
+		l.SetLimit(time.Second, 0)
+		c.Assert(l.Remains(), check.Equals, 0)
+		c.Assert(l.Take(), check.Equals, ErrNoMoreTokens)
+		c.Assert(l.String(), check.Matches, ".*limit 0 tokens in 1s.*")
+	}
+}
+
+var allLimiters = map[string]func(time.Duration, int) Limiter{
+	"sliding log":  NewLimiter,
+	"token bucket": NewTokenBucket,
+	"gcra":         NewGCRA,
+	"composite": func(w time.Duration, n int) Limiter {
+		return NewComposite(Tier{w, n}, Tier{w * 2, n * 2})
+	},
+}
+
+func (s *rateSuit) TestTakeN(c *check.C) {
+	for name, newFn := range allLimiters {
+		c.Log(name)
+
+		l := newFn(time.Second, 10)
+		c.Assert(l.TakeN(0), check.IsNil)
+		c.Assert(l.TakeN(7), check.IsNil)
+		c.Assert(l.Taken(), check.Equals, 7)
+
+		// all or none
+		c.Assert(l.TakeN(4), check.Equals, ErrNoMoreTokens)
+		c.Assert(l.Taken(), check.Equals, 7)
+		c.Assert(l.TakeN(3), check.IsNil)
+		c.Assert(l.Remains(), check.Equals, 0)
+
+		// never more than the limit
+		l = newFn(time.Second, 10)
+		c.Assert(l.TakeN(11), check.Equals, ErrNoMoreTokens)
+		c.Assert(l.Remains(), check.Equals, 10)
+	}
+}
+
+func (s *rateSuit) TestSlidingLogGrowth(c *check.C) {
+	slots := func(l Limiter) int { return len(l.(*limiter).load().slots) }
+
+	// the slots are allocated on demand, not by the limit
+	l := NewLimiter(time.Hour, 1<<30)
+	c.Assert(slots(l), check.Equals, 0)
+	c.Assert(l.Remains(), check.Equals, 1<<30)
+	for i := 0; i < 100; i++ {
+		c.Assert(l.Take(), check.IsNil)
+	}
+	c.Assert(l.TakeN(1000), check.IsNil)
+	c.Assert(slots(l) >= 1100 && slots(l) <= 2200, check.Equals, true, check.Commentf("slots %d", slots(l)))
+	c.Assert(l.Taken(), check.Equals, 1100)
+	c.Assert(l.Remains(), check.Equals, 1<<30-1100)
+
+	// the outdated slots are reused, and never grown beyond the limit
+	l = NewLimiter(time.Millisecond*20, 12)
+	c.Assert(l.TakeN(8), check.IsNil)
+	c.Assert(slots(l), check.Equals, 8)
+	time.Sleep(time.Millisecond * 30)
+	c.Assert(l.TakeN(8), check.IsNil)
+	c.Assert(slots(l), check.Equals, 8)
+	c.Assert(l.TakeN(4), check.IsNil)
+	c.Assert(slots(l), check.Equals, 12)
+	c.Assert(l.Take(), check.Equals, ErrNoMoreTokens)
+	c.Assert(l.Taken(), check.Equals, 12)
+
+	// the latest tokens are kept on the new limit
+	l.SetLimit(time.Millisecond*20, 1000)
+	c.Assert(slots(l), check.Equals, 12)
+	c.Assert(l.Taken(), check.Equals, 12)
+	c.Assert(l.Remains(), check.Equals, 988)
+	l.SetLimit(time.Millisecond*20, 5)
+	c.Assert(slots(l), check.Equals, 5)
+	c.Assert(l.Remains(), check.Equals, 0)
+}
+
+func (s *rateSuit) TestReserve(c *check.C) {
+	for name, newFn := range allLimiters {
+		c.Log(name)
+
+		l := newFn(time.Millisecond*200, 2)
+		c.Assert(l.Reserve(), check.Equals, time.Duration(0))
+		c.Assert(l.TakeN(2), check.IsNil)
+
+		// the sliding log regains the token after the whole window,
+		// the others regain one token every 100ms
+		d := l.Reserve()
+		c.Assert(d > time.Millisecond*50 && d <= time.Millisecond*200, check.Equals, true, check.Commentf("%s reserve %s", name, d))
+		c.Assert(l.Take(), check.Equals, ErrNoMoreTokens)
+
+		// the token is available exactly after the reserved duration
+		time.Sleep(d)
+		c.Assert(l.Reserve(), check.Equals, time.Duration(0))
+		c.Assert(l.Take(), check.IsNil)
+
+		// zero limit never available
+		l.SetLimit(time.Millisecond*200, 0)
+		c.Assert(l.Reserve() > time.Hour, check.Equals, true)
+	}
+}
+
+func (s *rateSuit) TestWait(c *check.C) {
+	for name, newFn := range allLimiters {
+		c.Log(name)
+
+		l := newFn(time.Millisecond*100, 1)
+		c.Assert(l.Wait(context.Background()), check.IsNil)
+
+		// block until the next token
+		startAt := time.Now()
+		c.Assert(l.Wait(context.Background()), check.IsNil)
+		elapsed := time.Since(startAt)
+		c.Assert(elapsed >= time.Millisecond*90 && elapsed < time.Millisecond*500, check.Equals, true, check.Commentf("%s wait %s", name, elapsed))
+
+		// canceled by the ctx
+		ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond*30)
+		err := l.Wait(ctx)
+		cancel()
+		c.Assert(err, check.Equals, context.DeadlineExceeded)
+
+		// zero limit blocks until the ctx done
+		l.SetLimit(time.Millisecond*100, 0)
+		ctx, cancel = context.WithTimeout(context.Background(), time.Millisecond*30)
+		err = l.Wait(ctx)
+		cancel()
+		c.Assert(err, check.Equals, context.DeadlineExceeded)
+	}
+}
+
+func (s *rateSuit) TestConcurrently(c *check.C) {
+	for name, newFn := range allLimiters {
+		c.Log(name)
+
+		var (
+			l          = newFn(time.Hour, 1000)
+			taken      int64
+			violations int64
+			stop       = make(chan struct{})
+			readers    sync.WaitGroup
+			takers     sync.WaitGroup
+		)
+
+		// the readers run against the takers
+		for i := 0; i < 4; i++ {
+			readers.Add(1)
+			go func() {
+				defer readers.Done()
+				for {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					if n := l.Remains(); n < 0 || n > 1000 {
+						atomic.AddInt64(&violations, 1)
+					}
+					if n := l.Taken(); n < 0 || n > 1000 {
+						atomic.AddInt64(&violations, 1)
+					}
+					if l.Reserve() < 0 {
+						atomic.AddInt64(&violations, 1)
+					}
+					_ = l.String()
+				}
+			}()
+		}
+
+		for i := 0; i < 16; i++ {
+			takers.Add(1)
+			go func() {
+				defer takers.Done()
+				for j := 0; j < 200; j++ {
+					if j%2 == 0 {
+						if l.TakeN(2) == nil {
+							atomic.AddInt64(&taken, 2)
+						}
+					} else if l.Take() == nil {
+						atomic.AddInt64(&taken, 1)
+					}
+				}
+			}()
+		}
+		takers.Wait()
+		close(stop)
+		readers.Wait()
+
+		// never exceed the limit
+		c.Assert(atomic.LoadInt64(&violations), check.Equals, int64(0))
+		c.Assert(atomic.LoadInt64(&taken), check.Equals, int64(1000), check.Commentf(name))
+		c.Assert(l.Taken(), check.Equals, 1000)
+		c.Assert(l.Remains(), check.Equals, 0)
+	}
+}
+
+func (s *rateSuit) TestSetLimitConcurrently(c *check.C) {
+	for name, newFn := range allLimiters {
+		c.Log(name)
+
+		var (
+			l  = newFn(time.Hour, 100)
+			wg sync.WaitGroup
+		)
+		for i := 0; i < 8; i++ {
+			wg.Add(1)
+			go func(i int) {
+				defer wg.Done()
+				for j := 0; j < 500; j++ {
+					switch {
+					case i == 0 && j%10 == 0:
+						l.SetLimit(time.Hour, 50+j%100)
+					default:
+						l.Take()
+						l.Remains()
+					}
+				}
+			}(i)
+		}
+		wg.Wait()
+
+		l.SetLimit(time.Hour, 10)
+		c.Assert(l.Take(), check.Equals, ErrNoMoreTokens)
+
+		// note: the composite only rescales its 1h tier, the 2h tier
+		// may bind as it's taken more than the 1h tier keeps
+		if comp, ok := l.(*Composite); ok {
+			c.Assert(comp.tiers[0].l.Taken(), check.Equals, 10)
+			c.Assert(comp.tiers[0].l.Remains(), check.Equals, 0)
+			continue
+		}
+		c.Assert(l.Taken(), check.Equals, 10)
+	}
+}
+
+//
+// benchmarks: 100k events per minute
+//
+
+func benchmarkTake(b *testing.B, l Limiter) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l.Take()
+	}
+}
+
+func BenchmarkSlidingLogTake(b *testing.B) {
+	benchmarkTake(b, NewLimiter(time.Minute, 100000))
+}
+
+func BenchmarkTokenBucketTake(b *testing.B) {
+	benchmarkTake(b, NewTokenBucket(time.Minute, 100000))
+}
+
+func BenchmarkGCRATake(b *testing.B) {
+	benchmarkTake(b, NewGCRA(time.Minute, 100000))
+}
+
+// the full window: fill all of the tokens, then check the remains
+func benchmarkRemains(b *testing.B, l Limiter) {
+	for l.Take() == nil {
+	}
+	b.ResetTimer()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		l.Remains()
+	}
+}
+
+func BenchmarkSlidingLogRemains(b *testing.B) {
+	benchmarkRemains(b, NewLimiter(time.Minute, 100000))
+}
+
+func BenchmarkTokenBucketRemains(b *testing.B) {
+	benchmarkRemains(b, NewTokenBucket(time.Minute, 100000))
+}
+
+func BenchmarkGCRARemains(b *testing.B) {
+	benchmarkRemains(b, NewGCRA(time.Minute, 100000))
+}
+
+//
+// benchmarks under high contention
+//
+
+// the limit is reached, so most of the takes are rejected
+func benchmarkTakeParallel(b *testing.B, l Limiter) {
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.Take()
+		}
+	})
+}
+
+func BenchmarkSlidingLogTakeParallel(b *testing.B) {
+	benchmarkTakeParallel(b, NewLimiter(time.Minute, 100000))
+}
+
+func BenchmarkTokenBucketTakeParallel(b *testing.B) {
+	benchmarkTakeParallel(b, NewTokenBucket(time.Minute, 100000))
+}
+
+func BenchmarkGCRATakeParallel(b *testing.B) {
+	benchmarkTakeParallel(b, NewGCRA(time.Minute, 100000))
+}
+
+// the readers against a writer
+func benchmarkRemainsParallel(b *testing.B, l Limiter) {
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		for {
+			select {
+			case <-stop:
+				return
+			default:
+				l.Take()
+			}
+		}
+	}()
+
+	b.ResetTimer()
+	b.ReportAllocs()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			l.Remains()
+		}
+	})
+}
+
+func BenchmarkSlidingLogRemainsParallel(b *testing.B) {
+	benchmarkRemainsParallel(b, NewLimiter(time.Minute, 100000))
+}
+
+func BenchmarkTokenBucketRemainsParallel(b *testing.B) {
+	benchmarkRemainsParallel(b, NewTokenBucket(time.Minute, 100000))
+}
+
+func BenchmarkGCRARemainsParallel(b *testing.B) {
+	benchmarkRemainsParallel(b, NewGCRA(time.Minute, 100000))
+}
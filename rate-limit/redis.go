@@ -0,0 +1,417 @@
+package rate
+
+import (
+	"bufio"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+var (
+	errRedisNil = errors.New("redis: nil reply")
+)
+
+// redisTakeScript trim the outdated events, count the events in the window, and
+// add the events if under the limit, all by the server time in microseconds.
+// KEYS[1]: the key, ARGV: window in microseconds, limit, n, the members' unique
+// prefix, expiry in milliseconds. it returns {count, 1 if added else 0}.
+//
+// note: replicate_commands is required to write after TIME before redis 5
+const redisTakeScript = `
+redis.replicate_commands()
+local t = redis.call('TIME')
+local now = tonumber(t[1]) * 1000000 + tonumber(t[2])
+local min = now - tonumber(ARGV[1])
+redis.call('ZREMRANGEBYSCORE', KEYS[1], '-inf', '(' .. string.format('%d', min))
+local count = redis.call('ZCARD', KEYS[1])
+local n = tonumber(ARGV[3])
+if count + n > tonumber(ARGV[2]) then
+	return {count, 0}
+end
+local score = string.format('%d', now)
+for i = 1, n do
+	redis.call('ZADD', KEYS[1], score, score .. '-' .. ARGV[4] .. '-' .. i)
+end
+redis.call('PEXPIRE', KEYS[1], ARGV[5])
+return {count + n, 1}
+`
+
+var redisTakeSHA = func() string {
+	sum := sha1.Sum([]byte(redisTakeScript))
+	return hex.EncodeToString(sum[:])
+}()
+
+// RedisOptions is the optional settings of the redis store
+type RedisOptions struct {
+	// Addr is the redis server address, default 127.0.0.1:6379
+	Addr string
+	// Password is used to AUTH if not empty
+	Password string
+	// DB is the redis database to SELECT
+	DB int
+	// Prefix is prepended to the keys, default "rate:"
+	Prefix string
+	// DialTimeout is the timeout of connecting, default 5s
+	DialTimeout time.Duration
+	// Timeout is the read & write timeout of each command, default 3s
+	Timeout time.Duration
+	// MaxIdle is the max idle connections kept in the pool, default 8
+	MaxIdle int
+}
+
+// RedisStore is the Store on a redis server by the RESP protocol, the events
+// of each key are kept in a sorted set scored by the server time in microseconds,
+// the trim, check & add of Take is atomic by a lua script, so it never fails on
+// the contention, and the server time is used so the clocks of the processes don't matter.
+type RedisStore struct {
+	opts RedisOptions
+	id   string // the random id of the store, to make the event members unique
+	seq  uint64 // atomic, the sequence of the event members
+	idle chan *redisConn
+}
+
+// NewRedisStore is exported
+func NewRedisStore(opts *RedisOptions) *RedisStore {
+	o := RedisOptions{}
+	if opts != nil {
+		o = *opts
+	}
+	if o.Addr == "" {
+		o.Addr = "127.0.0.1:6379"
+	}
+	if o.Prefix == "" {
+		o.Prefix = "rate:"
+	}
+	if o.DialTimeout <= 0 {
+		o.DialTimeout = time.Second * 5
+	}
+	if o.Timeout <= 0 {
+		o.Timeout = time.Second * 3
+	}
+	if o.MaxIdle <= 0 {
+		o.MaxIdle = 8
+	}
+
+	id := make([]byte, 8)
+	rand.Read(id)
+
+	return &RedisStore{
+		opts: o,
+		id:   hex.EncodeToString(id),
+		idle: make(chan *redisConn, o.MaxIdle),
+	}
+}
+
+// Take implement Store interface, the script is run by EVALSHA, and
+// loaded by EVAL once the server doesn't have it
+func (s *RedisStore) Take(key string, w time.Duration, limit, n int) (count int, ok bool, err error) {
+	var (
+		prefix = s.id + "-" + strconv.FormatUint(atomic.AddUint64(&s.seq, 1), 10)
+		args   = []string{
+			"1", s.opts.Prefix + key,
+			strconv.FormatInt(int64(w/time.Microsecond), 10),
+			strconv.Itoa(limit),
+			strconv.Itoa(n),
+			prefix,
+			strconv.FormatInt(int64(w/time.Millisecond)+1, 10),
+		}
+	)
+
+	err = s.with(func(c *redisConn) error {
+		reply, err := c.do1(append([]string{"EVALSHA", redisTakeSHA}, args...)...)
+		if rerr, isErr := err.(redisError); isErr && strings.HasPrefix(string(rerr), "NOSCRIPT") {
+			reply, err = c.do1(append([]string{"EVAL", redisTakeScript}, args...)...)
+		}
+		if err != nil {
+			return err
+		}
+
+		items, _ := reply.([]interface{})
+		if len(items) != 2 {
+			return fmt.Errorf("redis: unexpected script reply %v", reply)
+		}
+		n1, ok1 := items[0].(int64)
+		n2, ok2 := items[1].(int64)
+		if !ok1 || !ok2 {
+			return fmt.Errorf("redis: unexpected script reply %v", reply)
+		}
+		count, ok = int(n1), n2 == 1
+		return nil
+	})
+
+	return count, ok, err
+}
+
+// Count implement Store interface
+func (s *RedisStore) Count(key string, w time.Duration) (count int, err error) {
+	key = s.opts.Prefix + key
+
+	err = s.with(func(c *redisConn) error {
+		now, err := redisTime(c.do1("TIME"))
+		if err != nil {
+			return err
+		}
+		min := now - int64(w/time.Microsecond)
+		count, err = redisInt(c.do([]string{"ZCOUNT", key, strconv.FormatInt(min, 10), "+inf"}))
+		return err
+	})
+
+	return count, err
+}
+
+// Reserve implement Store interface
+func (s *RedisStore) Reserve(key string, w time.Duration, limit int) (d time.Duration, err error) {
+	key = s.opts.Prefix + key
+
+	err = s.with(func(c *redisConn) error {
+		now, err := redisTime(c.do1("TIME"))
+		if err != nil {
+			return err
+		}
+		min := strconv.FormatInt(now-int64(w/time.Microsecond), 10)
+
+		count, err := redisInt(c.do([]string{"ZCOUNT", key, min, "+inf"}))
+		if err != nil || count < limit {
+			return err
+		}
+
+		// the oldest one beyond the limit - 1 line is outdated just after the window
+		replies, err := c.do([]string{"ZRANGEBYSCORE", key, min, "+inf", "WITHSCORES", "LIMIT", strconv.Itoa(count - limit), "1"})
+		if err != nil {
+			return err
+		}
+		if err, isErr := replies[0].(redisError); isErr {
+			return err
+		}
+		items, _ := replies[0].([]interface{})
+		if len(items) != 2 {
+			return nil // outdated meanwhile
+		}
+		score, _ := items[1].(string)
+		at, err := strconv.ParseFloat(score, 64)
+		if err != nil {
+			return fmt.Errorf("redis: invalid score %q", score)
+		}
+		if d = time.Duration(int64(at)+int64(w/time.Microsecond)-now+1) * time.Microsecond; d < 0 {
+			d = 0
+		}
+		return nil
+	})
+
+	return d, err
+}
+
+// Close close the idle connections
+func (s *RedisStore) Close() error {
+	for {
+		select {
+		case c := <-s.idle:
+			c.Close()
+		default:
+			return nil
+		}
+	}
+}
+
+// with run fn on a pooled connection, the connection is dropped on the
+// I/O or protocol errors as its state is unknown, but kept on the error replies
+func (s *RedisStore) with(fn func(*redisConn) error) error {
+	c, err := s.get()
+	if err != nil {
+		return err
+	}
+
+	if err = fn(c); err != nil {
+		if _, isErr := err.(redisError); !isErr {
+			c.Close()
+			return err
+		}
+	}
+
+	select {
+	case s.idle <- c:
+	default:
+		c.Close()
+	}
+	return err
+}
+
+func (s *RedisStore) get() (*redisConn, error) {
+	select {
+	case c := <-s.idle:
+		return c, nil
+	default:
+	}
+
+	conn, err := net.DialTimeout("tcp", s.opts.Addr, s.opts.DialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{Conn: conn, r: bufio.NewReader(conn), timeout: s.opts.Timeout}
+
+	if s.opts.Password != "" {
+		if _, err := c.do1("AUTH", s.opts.Password); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	if s.opts.DB != 0 {
+		if _, err := c.do1("SELECT", strconv.Itoa(s.opts.DB)); err != nil {
+			c.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// redisError is the error reply of the server, the connection is still usable
+type redisError string
+
+func (e redisError) Error() string {
+	return "redis: " + string(e)
+}
+
+// redisConn is a minimal RESP client connection, the replies are decoded as:
+// simple string & bulk string -> string, integer -> int64, array -> []interface{},
+// error -> redisError, nil -> nil
+type redisConn struct {
+	net.Conn
+	r       *bufio.Reader
+	timeout time.Duration
+}
+
+// do send the commands in pipeline and read all of the replies, the
+// error replies are returned in the replies, not as the error
+func (c *redisConn) do(cmds ...[]string) ([]interface{}, error) {
+	c.SetDeadline(time.Now().Add(c.timeout))
+
+	var buf []byte
+	for _, cmd := range cmds {
+		buf = append(buf, '*')
+		buf = strconv.AppendInt(buf, int64(len(cmd)), 10)
+		buf = append(buf, '\r', '\n')
+		for _, arg := range cmd {
+			buf = append(buf, '$')
+			buf = strconv.AppendInt(buf, int64(len(arg)), 10)
+			buf = append(buf, '\r', '\n')
+			buf = append(buf, arg...)
+			buf = append(buf, '\r', '\n')
+		}
+	}
+	if _, err := c.Write(buf); err != nil {
+		return nil, err
+	}
+
+	replies := make([]interface{}, 0, len(cmds))
+	for range cmds {
+		reply, err := c.read()
+		if err != nil {
+			return nil, err
+		}
+		replies = append(replies, reply)
+	}
+	return replies, nil
+}
+
+// do1 send one command and return its reply, the error reply is returned as the error
+func (c *redisConn) do1(args ...string) (interface{}, error) {
+	replies, err := c.do(args)
+	if err != nil {
+		return nil, err
+	}
+	if err, isErr := replies[0].(redisError); isErr {
+		return nil, err
+	}
+	return replies[0], nil
+}
+
+func (c *redisConn) read() (interface{}, error) {
+	line, err := c.r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, fmt.Errorf("redis: invalid reply line %q", line)
+	}
+	typ, line := line[0], line[1:len(line)-2]
+
+	switch typ {
+	case '+':
+		return line, nil
+	case '-':
+		return redisError(line), nil
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		size, err := strconv.Atoi(line)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		buf := make([]byte, size+2)
+		if _, err := io.ReadFull(c.r, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:size]), nil
+	case '*':
+		size, err := strconv.Atoi(line)
+		if err != nil || size < 0 {
+			return nil, err
+		}
+		items := make([]interface{}, 0, size)
+		for i := 0; i < size; i++ {
+			item, err := c.read()
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+		return items, nil
+	}
+	return nil, fmt.Errorf("redis: invalid reply type %q", typ)
+}
+
+// redisInt decode the first reply as an integer
+func redisInt(replies []interface{}, err error) (int, error) {
+	if err != nil {
+		return 0, err
+	}
+	switch reply := replies[0].(type) {
+	case int64:
+		return int(reply), nil
+	case redisError:
+		return 0, reply
+	case nil:
+		return 0, errRedisNil
+	}
+	return 0, fmt.Errorf("redis: unexpected reply %v", replies[0])
+}
+
+// redisTime decode the reply of TIME as the unix time in microseconds
+func redisTime(reply interface{}, err error) (int64, error) {
+	if err != nil {
+		return 0, err
+	}
+	if err, isErr := reply.(redisError); isErr {
+		return 0, err
+	}
+	items, _ := reply.([]interface{})
+	if len(items) != 2 {
+		return 0, fmt.Errorf("redis: unexpected TIME reply %v", reply)
+	}
+	sec, _ := items[0].(string)
+	usec, _ := items[1].(string)
+	s, err1 := strconv.ParseInt(sec, 10, 64)
+	us, err2 := strconv.ParseInt(usec, 10, 64)
+	if err1 != nil || err2 != nil {
+		return 0, fmt.Errorf("redis: unexpected TIME reply %v", reply)
+	}
+	return s*1e6 + us, nil
+}